@@ -0,0 +1,89 @@
+package blehdb
+
+import (
+	"fmt"
+	"net"
+)
+
+// privateBlocks are the address ranges preferred when deriving an advertise
+// address from a wildcard bind address.
+var privateBlocks = []string{
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"100.64.0.0/10",
+}
+
+// advertiseAddr returns the address to publish to peers for a bind address.
+// An explicit advertise address is returned as is. Otherwise the bind address
+// is used, with a wildcard or missing host replaced by a private IP of this
+// host.
+func advertiseAddr(bind, advertise string) (string, error) {
+	if advertise != "" {
+		if _, _, err := net.SplitHostPort(advertise); err != nil {
+			return "", fmt.Errorf("invalid advertise address '%s': %v", advertise, err)
+		}
+		return advertise, nil
+	}
+
+	host, port, err := net.SplitHostPort(bind)
+	if err != nil {
+		return "", fmt.Errorf("invalid bind address '%s': %v", bind, err)
+	}
+
+	if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+		return bind, nil
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+
+	ip, err := privateIP(addrs)
+	if err != nil {
+		return "", fmt.Errorf("cannot derive an advertise address for '%s': %v", bind, err)
+	}
+
+	return net.JoinHostPort(ip.String(), port), nil
+}
+
+// privateIP picks the address to advertise from the host's interface
+// addresses: the first private IPv4 address, or failing that the first
+// non-loopback IPv4 address.
+func privateIP(addrs []net.Addr) (net.IP, error) {
+	var private []*net.IPNet
+	for _, block := range privateBlocks {
+		_, n, _ := net.ParseCIDR(block)
+		private = append(private, n)
+	}
+
+	var fallback net.IP
+	for _, addr := range addrs {
+		n, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+
+		ip := n.IP.To4()
+		if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+			continue
+		}
+
+		for _, p := range private {
+			if p.Contains(ip) {
+				return ip, nil
+			}
+		}
+
+		if fallback == nil {
+			fallback = ip
+		}
+	}
+
+	if fallback == nil {
+		return nil, fmt.Errorf("no usable IPv4 address found")
+	}
+
+	return fallback, nil
+}
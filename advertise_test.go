@@ -0,0 +1,66 @@
+package blehdb
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAdvertiseAddr(t *testing.T) {
+	addr, err := advertiseAddr(":11000", "203.0.113.1:11000")
+	if err != nil || addr != "203.0.113.1:11000" {
+		t.Errorf("expected explicit advertise address, got: %v, %v", addr, err)
+	}
+
+	addr, err = advertiseAddr("10.0.0.1:11000", "")
+	if err != nil || addr != "10.0.0.1:11000" {
+		t.Errorf("expected bind address, got: %v, %v", addr, err)
+	}
+
+	addr, err = advertiseAddr("node1.example.com:11000", "")
+	if err != nil || addr != "node1.example.com:11000" {
+		t.Errorf("expected bind address, got: %v, %v", addr, err)
+	}
+
+	if _, err := advertiseAddr(":11000", "203.0.113.1"); err == nil {
+		t.Error("expected an error for an advertise address without a port")
+	}
+
+	if _, err := advertiseAddr("11000", ""); err == nil {
+		t.Error("expected an error for an invalid bind address")
+	}
+}
+
+func TestPrivateIP(t *testing.T) {
+	parse := func(cidrs ...string) []net.Addr {
+		var addrs []net.Addr
+		for _, c := range cidrs {
+			ip, n, err := net.ParseCIDR(c)
+			if err != nil {
+				t.Fatalf("error parsing %s: %v", c, err)
+			}
+			n.IP = ip
+			addrs = append(addrs, n)
+		}
+		return addrs
+	}
+
+	cases := []struct {
+		addrs []net.Addr
+		ip    string
+	}{
+		{parse("127.0.0.1/8", "203.0.113.7/24", "192.168.1.10/24"), "192.168.1.10"},
+		{parse("127.0.0.1/8", "169.254.1.1/16", "203.0.113.7/24"), "203.0.113.7"},
+		{parse("::1/128", "fd00::1/64", "10.1.2.3/8"), "10.1.2.3"},
+	}
+
+	for _, c := range cases {
+		ip, err := privateIP(c.addrs)
+		if err != nil || ip.String() != c.ip {
+			t.Errorf("%v: expected %s, got: %v, %v", c.addrs, c.ip, ip, err)
+		}
+	}
+
+	if _, err := privateIP(parse("127.0.0.1/8", "::1/128")); err == nil {
+		t.Error("expected an error with only loopback addresses")
+	}
+}
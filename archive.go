@@ -0,0 +1,349 @@
+package blehdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/joshkrueger/blehdb/store"
+)
+
+const (
+	archiveLogFile     = "log.jsonl"
+	archiveSnapshotDir = "snapshots"
+)
+
+// archivedLog is a single committed raft log entry as written to the archive.
+type archivedLog struct {
+	Index uint64
+	Term  uint64
+	Time  time.Time
+	Data  []byte
+}
+
+// archivedSnapshot describes a snapshot stored in the archive.
+type archivedSnapshot struct {
+	Index uint64
+	Time  time.Time
+	Path  string
+}
+
+// logArchiver copies committed log entries and FSM snapshots into an archive
+// directory so that state can later be rebuilt at an arbitrary point in time.
+type logArchiver struct {
+	dir    string
+	logger *log.Logger
+
+	lock sync.Mutex
+	f    *os.File
+	enc  *json.Encoder
+
+	// lastLog and lastSnapshot are the highest indexes archived so far. Raft
+	// replays entries after the latest snapshot on every start, and those
+	// must not be archived twice.
+	lastLog      uint64
+	lastSnapshot uint64
+}
+
+func newLogArchiver(dir string, logger *log.Logger) (*logArchiver, error) {
+	if err := os.MkdirAll(filepath.Join(dir, archiveSnapshotDir), 0755); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, archiveLogFile)
+	lastLog, err := lastArchivedIndex(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading archived log: %v", err)
+	}
+
+	snaps, err := listArchivedSnapshots(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastSnapshot uint64
+	if len(snaps) > 0 {
+		lastSnapshot = snaps[len(snaps)-1].Index
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logArchiver{
+		dir:          dir,
+		logger:       logger,
+		f:            f,
+		enc:          json.NewEncoder(f),
+		lastLog:      lastLog,
+		lastSnapshot: lastSnapshot,
+	}, nil
+}
+
+// lastArchivedIndex returns the index of the last complete entry in the
+// archived log at path, reading backwards from the end of the file.
+func lastArchivedIndex(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+
+	for chunk := int64(4096); ; chunk *= 2 {
+		if chunk > size {
+			chunk = size
+		}
+
+		buf := make([]byte, chunk)
+		if _, err := f.ReadAt(buf, size-chunk); err != nil && err != io.EOF {
+			return 0, err
+		}
+
+		// Unless the whole file was read, the first line may be cut off.
+		lines := bytes.Split(bytes.TrimRight(buf, "\n"), []byte("\n"))
+		first := 1
+		if chunk == size {
+			first = 0
+		}
+
+		for i := len(lines) - 1; i >= first; i-- {
+			var entry archivedLog
+			if err := json.Unmarshal(lines[i], &entry); err == nil {
+				return entry.Index, nil
+			}
+		}
+
+		if chunk == size {
+			return 0, nil
+		}
+	}
+}
+
+func (a *logArchiver) archiveLog(l *raft.Log) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if l.Index <= a.lastLog {
+		return
+	}
+
+	// Entries are stamped with the time the leader appended them, so that
+	// every member archives the same commit time. Entries written by a raft
+	// release that predates AppendedAt carry no time and fall back to now.
+	at := l.AppendedAt
+	if at.IsZero() {
+		at = time.Now()
+	}
+
+	entry := &archivedLog{
+		Index: l.Index,
+		Term:  l.Term,
+		Time:  at.UTC(),
+		Data:  l.Data,
+	}
+
+	if err := a.enc.Encode(entry); err != nil {
+		a.logger.Printf("error archiving log entry %d: %v", l.Index, err)
+		return
+	}
+	a.lastLog = l.Index
+}
+
+func (a *logArchiver) archiveSnapshot(index uint64, snap []byte) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if index <= a.lastSnapshot {
+		return
+	}
+
+	name := fmt.Sprintf("snapshot-%d-%d.json", index, time.Now().UTC().UnixNano())
+	path := filepath.Join(a.dir, archiveSnapshotDir, name)
+
+	// Write to a temporary file first so a partially written snapshot is never
+	// picked up during recovery.
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, snap, 0644); err != nil {
+		a.logger.Printf("error archiving snapshot at index %d: %v", index, err)
+		return
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		a.logger.Printf("error archiving snapshot at index %d: %v", index, err)
+		return
+	}
+	a.lastSnapshot = index
+}
+
+func (a *logArchiver) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.f.Close()
+}
+
+func listArchivedSnapshots(dir string) ([]*archivedSnapshot, error) {
+	files, err := ioutil.ReadDir(filepath.Join(dir, archiveSnapshotDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var snaps []*archivedSnapshot
+	for _, f := range files {
+		if filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+
+		var index uint64
+		var nanos int64
+		if _, err := fmt.Sscanf(f.Name(), "snapshot-%d-%d.json", &index, &nanos); err != nil {
+			continue
+		}
+
+		snaps = append(snaps, &archivedSnapshot{
+			Index: index,
+			Time:  time.Unix(0, nanos).UTC(),
+			Path:  filepath.Join(dir, archiveSnapshotDir, f.Name()),
+		})
+	}
+
+	sort.Slice(snaps, func(i, j int) bool {
+		return snaps[i].Index < snaps[j].Index
+	})
+
+	return snaps, nil
+}
+
+// RecoveryTarget selects the point in time to recover to. A zero Index or Time
+// leaves that bound unset; if both are zero the whole archive is replayed.
+type RecoveryTarget struct {
+	// Index is the last raft index to include.
+	Index uint64
+
+	// Time is the latest commit time to include.
+	Time time.Time
+}
+
+func (t RecoveryTarget) includes(index uint64, at time.Time) bool {
+	if t.Index != 0 && index > t.Index {
+		return false
+	}
+	if !t.Time.IsZero() && at.After(t.Time) {
+		return false
+	}
+	return true
+}
+
+// RecoverStore rebuilds the state found in an archive directory as of the given
+// target. It starts from the latest archived snapshot within the target and
+// replays the archived log entries that follow it. The index of the last
+// applied entry is returned along with the store.
+func RecoverStore(dir string, target RecoveryTarget) (*store.BlehStore, uint64, error) {
+	return RecoverStoreWithKeys(dir, target, nil)
+}
+
+// RecoverStoreWithKeys is like RecoverStore but decrypts an archive written by
+// a server configured with a KeyProvider.
+func RecoverStoreWithKeys(dir string, target RecoveryTarget, keys KeyProvider) (*store.BlehStore, uint64, error) {
+	fsm, err := NewFSM()
+	if err != nil {
+		return nil, 0, err
+	}
+	fsm.logger = log.New(ioutil.Discard, "", 0)
+
+	if keys != nil {
+		fsm.keyring, err = newKeyring(keys)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	snaps, err := listArchivedSnapshots(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var base *archivedSnapshot
+	for _, snap := range snaps {
+		if target.includes(snap.Index, snap.Time) {
+			base = snap
+		}
+	}
+
+	var applied uint64
+	if base != nil {
+		f, err := os.Open(base.Path)
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := fsm.Restore(f); err != nil {
+			f.Close()
+			return nil, 0, fmt.Errorf("restoring snapshot %s: %v", base.Path, err)
+		}
+		f.Close()
+		applied = base.Index
+	}
+
+	f, err := os.Open(filepath.Join(dir, archiveLogFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fsm.Store(), applied, nil
+		}
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var entry archivedLog
+		err := dec.Decode(&entry)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// A trailing partial entry means the archiver was interrupted
+			// mid-write; everything before it is still usable.
+			break
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("reading archived log: %v", err)
+		}
+
+		if entry.Index <= applied {
+			continue
+		}
+		if !target.includes(entry.Index, entry.Time) {
+			break
+		}
+
+		fsm.Apply(&raft.Log{
+			Index: entry.Index,
+			Term:  entry.Term,
+			Type:  raft.LogCommand,
+			Data:  entry.Data,
+		})
+		applied = entry.Index
+	}
+
+	return fsm.Store(), applied, nil
+}
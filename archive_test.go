@@ -0,0 +1,234 @@
+package blehdb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func setupArchive(t *testing.T) (*blehFSM, string) {
+	dir, err := ioutil.TempDir("", "blehdb-archive")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+
+	fsm := setupFSM(t)
+	fsm.archiver, err = newLogArchiver(dir, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("error creating archiver: %v", err)
+	}
+
+	return fsm, dir
+}
+
+func applyCommand(t *testing.T, fsm *blehFSM, index uint64, mt messageType, c *command) {
+	msg, err := encodeMessage(mt, c)
+	if err != nil {
+		t.Fatalf("error encoding message: %v", err)
+	}
+
+	l := mockLog(msg)
+	l.Index = index
+	if resp := fsm.Apply(l); resp != nil {
+		t.Fatalf("error applying raft log: %v", resp)
+	}
+}
+
+func TestRecoverStore(t *testing.T) {
+	fsm, dir := setupArchive(t)
+	defer os.RemoveAll(dir)
+
+	applyCommand(t, fsm, 1, CreateBucketRequestType, &command{Bucket: "foo"})
+	applyCommand(t, fsm, 2, SetItemRequestType, &command{Bucket: "foo", Key: "bar", Value: "baz"})
+	applyCommand(t, fsm, 3, DeleteBucketRequestType, &command{Bucket: "foo"})
+	fsm.archiver.Close()
+
+	s, applied, err := RecoverStore(dir, RecoveryTarget{Index: 2})
+	if err != nil {
+		t.Fatalf("error recovering store: %v", err)
+	}
+
+	if applied != 2 {
+		t.Errorf("expected to recover to index 2, got: %v", applied)
+	}
+
+	val, err := s.GetItem("foo", "bar")
+	if err != nil {
+		t.Fatalf("error fetching item: %v", err)
+	}
+
+	if val != "baz" {
+		t.Errorf("value should be: 'baz', got: '%v'", val)
+	}
+
+	s, applied, err = RecoverStore(dir, RecoveryTarget{})
+	if err != nil {
+		t.Fatalf("error recovering store: %v", err)
+	}
+
+	if applied != 3 || s.BucketExists("foo") {
+		t.Errorf("full replay should end with bucket 'foo' deleted at index 3")
+	}
+}
+
+func TestRecoverStore_fromSnapshot(t *testing.T) {
+	fsm, dir := setupArchive(t)
+	defer os.RemoveAll(dir)
+
+	applyCommand(t, fsm, 1, CreateBucketRequestType, &command{Bucket: "foo"})
+	applyCommand(t, fsm, 2, SetItemRequestType, &command{Bucket: "foo", Key: "bar", Value: "baz"})
+
+	snap, err := fsm.Snapshot()
+	if err != nil {
+		t.Fatalf("error taking snapshot: %v", err)
+	}
+	fs := snap.(*fsmSnapshot)
+	if fs.index != 2 {
+		t.Fatalf("snapshot should be taken at index 2, got: %v", fs.index)
+	}
+	fs.archiver.archiveSnapshot(fs.index, fs.snap)
+
+	applyCommand(t, fsm, 3, SetItemRequestType, &command{Bucket: "foo", Key: "bar", Value: "qux"})
+	fsm.archiver.Close()
+
+	// Remove the log so recovery can only succeed through the snapshot.
+	os.Remove(filepath.Join(dir, archiveLogFile))
+
+	s, applied, err := RecoverStore(dir, RecoveryTarget{Time: time.Now()})
+	if err != nil {
+		t.Fatalf("error recovering store: %v", err)
+	}
+
+	if applied != 2 {
+		t.Errorf("expected to recover to index 2, got: %v", applied)
+	}
+
+	val, _ := s.GetItem("foo", "bar")
+	if val != "baz" {
+		t.Errorf("value should be: 'baz', got: '%v'", val)
+	}
+}
+
+func TestArchiverSkipsArchivedEntries(t *testing.T) {
+	fsm, dir := setupArchive(t)
+	defer os.RemoveAll(dir)
+
+	applyCommand(t, fsm, 1, CreateBucketRequestType, &command{Bucket: "foo"})
+	applyCommand(t, fsm, 2, SetItemRequestType, &command{Bucket: "foo", Key: "bar", Value: "baz"})
+	fsm.archiver.Close()
+
+	// A restart replays the log after the latest snapshot.
+	var err error
+	fsm = setupFSM(t)
+	fsm.archiver, err = newLogArchiver(dir, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("error reopening archiver: %v", err)
+	}
+
+	if fsm.archiver.lastLog != 2 {
+		t.Fatalf("expected the archive to resume after index 2, got: %v", fsm.archiver.lastLog)
+	}
+
+	applyCommand(t, fsm, 1, CreateBucketRequestType, &command{Bucket: "foo"})
+	applyCommand(t, fsm, 2, SetItemRequestType, &command{Bucket: "foo", Key: "bar", Value: "baz"})
+	applyCommand(t, fsm, 3, SetItemRequestType, &command{Bucket: "foo", Key: "bar", Value: "qux"})
+	fsm.archiver.Close()
+
+	buf, err := ioutil.ReadFile(filepath.Join(dir, archiveLogFile))
+	if err != nil {
+		t.Fatalf("error reading archive: %v", err)
+	}
+
+	if lines := bytes.Count(buf, []byte("\n")); lines != 3 {
+		t.Errorf("expected 3 archived entries, got: %d", lines)
+	}
+}
+
+func TestArchiverCommitTime(t *testing.T) {
+	fsm, dir := setupArchive(t)
+	defer os.RemoveAll(dir)
+
+	committed := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	msg, _ := encodeMessage(CreateBucketRequestType, &command{Bucket: "foo"})
+	l := mockLog(msg)
+	l.AppendedAt = committed
+	fsm.Apply(l)
+	fsm.archiver.Close()
+
+	if _, applied, _ := RecoverStore(dir, RecoveryTarget{Time: committed}); applied != 1 {
+		t.Errorf("entry should be archived at its commit time, recovered to index: %v", applied)
+	}
+
+	if _, applied, _ := RecoverStore(dir, RecoveryTarget{Time: committed.Add(-time.Second)}); applied != 0 {
+		t.Errorf("entry committed after the target should not be recovered, recovered to index: %v", applied)
+	}
+}
+
+func TestArchiveSnapshotAfterRestore(t *testing.T) {
+	fsm := setupFSM(t)
+	applyCommand(t, fsm, 1, CreateBucketRequestType, &command{Bucket: "foo"})
+	applyCommand(t, fsm, 2, SetItemRequestType, &command{Bucket: "foo", Key: "bar", Value: "baz"})
+
+	snap, err := fsm.Snapshot()
+	if err != nil {
+		t.Fatalf("error taking snapshot: %v", err)
+	}
+
+	restored, dir := setupArchive(t)
+	defer os.RemoveAll(dir)
+
+	err = restored.Restore(ioutil.NopCloser(bytes.NewReader(snap.(*fsmSnapshot).snap)))
+	if err != nil {
+		t.Fatalf("error restoring snapshot: %v", err)
+	}
+
+	snap, err = restored.Snapshot()
+	if err != nil {
+		t.Fatalf("error taking snapshot: %v", err)
+	}
+
+	if index := snap.(*fsmSnapshot).index; index != 2 {
+		t.Errorf("a snapshot after restore should be at the restored index 2, got: %v", index)
+	}
+}
+
+func TestArchiveInstalledSnapshot(t *testing.T) {
+	leader := setupFSM(t)
+	applyCommand(t, leader, 1, CreateBucketRequestType, &command{Bucket: "foo"})
+	applyCommand(t, leader, 2, SetItemRequestType, &command{Bucket: "foo", Key: "bar", Value: "baz"})
+
+	snap, err := leader.Snapshot()
+	if err != nil {
+		t.Fatalf("error taking snapshot: %v", err)
+	}
+
+	// A follower that lags behind the leader's log is sent the snapshot
+	// instead of entries 1 and 2, which it never archives.
+	follower, dir := setupArchive(t)
+	defer os.RemoveAll(dir)
+
+	err = follower.Restore(ioutil.NopCloser(bytes.NewReader(snap.(*fsmSnapshot).snap)))
+	if err != nil {
+		t.Fatalf("error restoring snapshot: %v", err)
+	}
+	applyCommand(t, follower, 3, SetItemRequestType, &command{Bucket: "foo", Key: "qux", Value: "quux"})
+	follower.archiver.Close()
+
+	s, applied, err := RecoverStore(dir, RecoveryTarget{})
+	if err != nil {
+		t.Fatalf("error recovering store: %v", err)
+	}
+
+	if applied != 3 {
+		t.Errorf("expected to recover to index 3, got: %v", applied)
+	}
+
+	if val, _ := s.GetItem("foo", "bar"); val != "baz" {
+		t.Errorf("expected the installed snapshot to be recovered, got: '%v'", val)
+	}
+}
@@ -0,0 +1,298 @@
+package blehdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// ErrAutopilotDisabled is returned when cluster health is requested from a
+// cluster whose leader does not run autopilot.
+var ErrAutopilotDisabled = errors.New("autopilot is not enabled")
+
+// ServerHealth describes the health of a single member as tracked by the
+// leader's autopilot.
+type ServerHealth struct {
+	ID         string `json:"id"`
+	Address    string `json:"address"`
+	RPCAddress string `json:"rpc_address"`
+	NonVoter   bool   `json:"non_voter"`
+	Leader     bool   `json:"leader"`
+
+	Healthy     bool      `json:"healthy"`
+	LastContact time.Time `json:"last_contact"`
+	Lag         uint64    `json:"lag"`
+
+	// StableSince is when the member last became healthy, and FailedSince
+	// when it last became unhealthy. Only one of them is set at a time.
+	StableSince time.Time `json:"stable_since"`
+	FailedSince time.Time `json:"failed_since"`
+
+	// Error is set when the member could not be reached.
+	Error string `json:"error,omitempty"`
+}
+
+// ClusterHealth is the leader's view of the health of the cluster.
+type ClusterHealth struct {
+	// Healthy is true when every member is healthy.
+	Healthy bool `json:"healthy"`
+
+	// FailureTolerance is how many more voters could fail without the
+	// cluster losing quorum.
+	FailureTolerance int `json:"failure_tolerance"`
+
+	Voters        int `json:"voters"`
+	HealthyVoters int `json:"healthy_voters"`
+
+	Servers   []*ServerHealth `json:"servers"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// quorum returns the number of voters needed for a majority.
+func quorum(voters int) int {
+	return voters/2 + 1
+}
+
+// autopilotState carries health tracking from one autopilot round to the next.
+type autopilotState struct {
+	lock   sync.RWMutex
+	health *ClusterHealth
+	prev   map[string]*ServerHealth
+}
+
+// update builds the cluster health from the peers' progress, carrying over
+// when each member became healthy or unhealthy. The local member, the leader,
+// is identified by its server ID and raft address.
+func (a *autopilotState) update(config *Config, id, addr string, peers []*PeerStatus, now time.Time) *ClusterHealth {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	servers := []*ServerHealth{{
+		ID:          id,
+		Address:     addr,
+		Leader:      true,
+		Healthy:     true,
+		LastContact: now,
+	}}
+
+	for _, p := range peers {
+		h := &ServerHealth{
+			ID:          p.ID,
+			Address:     p.Address,
+			RPCAddress:  p.RPCAddress,
+			NonVoter:    p.NonVoter,
+			LastContact: p.LastContact,
+			Lag:         p.Lag,
+			Error:       p.Error,
+		}
+		h.Healthy = h.Error == "" &&
+			h.Lag <= config.MaxTrailingLogs &&
+			now.Sub(h.LastContact) <= config.LastContactThreshold
+		servers = append(servers, h)
+	}
+
+	health := &ClusterHealth{
+		Healthy:   true,
+		UpdatedAt: now,
+	}
+	prev := make(map[string]*ServerHealth)
+	for _, h := range servers {
+		old, ok := a.prev[h.ID]
+		switch {
+		case h.Healthy && ok && old.Healthy:
+			h.StableSince = old.StableSince
+		case h.Healthy:
+			h.StableSince = now
+		case ok && !old.Healthy:
+			h.FailedSince = old.FailedSince
+		default:
+			h.FailedSince = now
+		}
+		prev[h.ID] = h
+
+		if !h.Healthy {
+			health.Healthy = false
+		}
+		if !h.NonVoter {
+			health.Voters++
+			if h.Healthy {
+				health.HealthyVoters++
+			}
+		}
+	}
+
+	health.FailureTolerance = health.HealthyVoters - quorum(health.Voters)
+	if health.FailureTolerance < 0 {
+		health.FailureTolerance = 0
+	}
+
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].Address < servers[j].Address
+	})
+	health.Servers = servers
+
+	a.health = health
+	a.prev = prev
+
+	return health
+}
+
+// reset forgets all tracked health, so that a new term as leader starts
+// afresh rather than from a view that may be long out of date.
+func (a *autopilotState) reset() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.health = nil
+	a.prev = nil
+}
+
+// current returns the health from the last autopilot round, if any.
+func (a *autopilotState) current() *ClusterHealth {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	return a.health
+}
+
+// stable reports whether the member has been healthy for at least d.
+func (a *autopilotState) stable(id string, d time.Duration, now time.Time) bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	h, ok := a.prev[id]
+	return ok && h.Healthy && now.Sub(h.StableSince) >= d
+}
+
+// deadServers returns the members that have been unhealthy for longer than
+// threshold and can be removed. Non-voters can always be removed. Voters are
+// only removed while the healthy voters remain a quorum of what is left, so
+// that autopilot never removes its way out of a majority.
+func (h *ClusterHealth) deadServers(threshold time.Duration, now time.Time) []*ServerHealth {
+	var dead []*ServerHealth
+	voters := h.Voters
+	for _, s := range h.Servers {
+		if s.Healthy || s.Leader || now.Sub(s.FailedSince) < threshold {
+			continue
+		}
+
+		if !s.NonVoter {
+			if h.HealthyVoters < quorum(voters-1) {
+				continue
+			}
+			voters--
+		}
+
+		dead = append(dead, s)
+	}
+
+	return dead
+}
+
+// runAutopilot periodically checks the health of the cluster and removes dead
+// members until stopCh is closed. It runs only while the local member leads.
+func (s *Server) runAutopilot(stopCh <-chan struct{}) {
+	s.autopilot.reset()
+
+	ticker := time.NewTicker(s.config.AutopilotInterval)
+	defer ticker.Stop()
+
+	for {
+		s.autopilotRound()
+
+		select {
+		case <-ticker.C:
+		case <-stopCh:
+			return
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+func (s *Server) autopilotRound() {
+	health, err := s.updateHealth()
+	if err != nil {
+		s.logger.Printf("autopilot: error checking cluster health: %v", err)
+		return
+	}
+
+	for _, dead := range health.deadServers(s.config.DeadServerThreshold, time.Now()) {
+		s.logger.Printf("autopilot: removing %s at %s, unhealthy since %v", dead.ID, dead.Address, dead.FailedSince)
+
+		ctx, cancel := context.WithTimeout(context.Background(), raftApplyTimeout)
+		err := s.removePeerLocal(ctx, dead.ID)
+		cancel()
+		if err != nil {
+			s.logger.Printf("autopilot: error removing %s: %v", dead.ID, err)
+			return
+		}
+	}
+}
+
+func (s *Server) updateHealth() (*ClusterHealth, error) {
+	lastIndex := parseStat(s.raft.Stats(), "last_log_index")
+
+	peers, err := s.peerStatuses(lastIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.autopilot.update(s.config, s.id, s.config.RaftAdvertise, peers, time.Now()), nil
+}
+
+// checkStable fails the promotion of a replica that autopilot has not yet seen
+// healthy for Config.ServerStabilizationTime. The replica retries until it
+// has been stable for long enough.
+func (s *Server) checkStable(id string) error {
+	if !s.config.Autopilot {
+		return nil
+	}
+
+	if m, ok := s.fsm.Member(id); !ok || !m.NonVoter {
+		return nil
+	}
+
+	if !s.autopilot.stable(id, s.config.ServerStabilizationTime, time.Now()) {
+		return fmt.Errorf("%s has not been healthy for %v yet", id, s.config.ServerStabilizationTime)
+	}
+
+	return nil
+}
+
+// ClusterHealth returns the leader's view of the health of the cluster. It can
+// be called on any member; followers ask the leader.
+func (s *Server) ClusterHealth(ctx context.Context) (*ClusterHealth, error) {
+	var health ClusterHealth
+	err := s.retryLeader(ctx, func() error {
+		if s.raft.State() != raft.Leader || s.isNonVoter() {
+			return s.forwardToLeader(ctx, "Management.ClusterHealth", &ClusterHealthRequest{}, &health)
+		}
+
+		if !s.config.Autopilot {
+			return ErrAutopilotDisabled
+		}
+
+		h := s.autopilot.current()
+		if h == nil {
+			var err error
+			if h, err = s.updateHealth(); err != nil {
+				return err
+			}
+		}
+
+		health = *h
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &health, nil
+}
@@ -0,0 +1,172 @@
+package blehdb
+
+import (
+	"testing"
+	"time"
+)
+
+func autopilotTestConfig() *Config {
+	config := DefaultConfig()
+	config.Autopilot = true
+	return config
+}
+
+func TestAutopilotUpdate(t *testing.T) {
+	config := autopilotTestConfig()
+	a := &autopilotState{}
+	now := time.Now()
+
+	peers := []*PeerStatus{
+		{ID: "b", Address: "b", LastContact: now},
+		{ID: "c", Address: "c", Error: "connection refused"},
+		{ID: "d", Address: "d", LastContact: now, Lag: config.MaxTrailingLogs + 1},
+		{ID: "e", Address: "e", LastContact: now, NonVoter: true},
+	}
+
+	health := a.update(config, "a", "a", peers, now)
+
+	healthy := make(map[string]bool)
+	for _, s := range health.Servers {
+		healthy[s.Address] = s.Healthy
+	}
+	expected := map[string]bool{"a": true, "b": true, "c": false, "d": false, "e": true}
+	for addr, ok := range expected {
+		if healthy[addr] != ok {
+			t.Errorf("expected %s healthy=%v", addr, ok)
+		}
+	}
+
+	if health.Healthy {
+		t.Error("expected the cluster to be unhealthy")
+	}
+	if health.Voters != 4 || health.HealthyVoters != 2 {
+		t.Errorf("unexpected voter counts: %d healthy of %d", health.HealthyVoters, health.Voters)
+	}
+	if health.FailureTolerance != 0 {
+		t.Errorf("expected no failure tolerance, got: %d", health.FailureTolerance)
+	}
+
+	later := now.Add(time.Minute)
+	peers[0].LastContact = later
+	health = a.update(config, "a", "a", peers, later)
+
+	for _, s := range health.Servers {
+		switch s.Address {
+		case "b":
+			if !s.StableSince.Equal(now) {
+				t.Errorf("expected b to be stable since %v, got: %v", now, s.StableSince)
+			}
+		case "c":
+			if !s.FailedSince.Equal(now) {
+				t.Errorf("expected c to have failed since %v, got: %v", now, s.FailedSince)
+			}
+		}
+	}
+
+	if !a.stable("b", 30*time.Second, later) {
+		t.Error("expected b to be stable")
+	}
+	if a.stable("c", 0, later) {
+		t.Error("expected c not to be stable")
+	}
+}
+
+func TestDeadServers(t *testing.T) {
+	now := time.Now()
+	failed := now.Add(-time.Hour)
+
+	cases := []struct {
+		name    string
+		servers []*ServerHealth
+		dead    []string
+	}{
+		{
+			name: "one of three",
+			servers: []*ServerHealth{
+				{Address: "a", Leader: true, Healthy: true},
+				{Address: "b", Healthy: true},
+				{Address: "c", FailedSince: failed},
+			},
+			dead: []string{"c"},
+		},
+		{
+			name: "recently failed",
+			servers: []*ServerHealth{
+				{Address: "a", Leader: true, Healthy: true},
+				{Address: "b", Healthy: true},
+				{Address: "c", FailedSince: now},
+			},
+		},
+		{
+			name: "no quorum",
+			servers: []*ServerHealth{
+				{Address: "a", Leader: true, Healthy: true},
+				{Address: "b", FailedSince: failed},
+				{Address: "c", FailedSince: failed},
+			},
+		},
+		{
+			name: "two of five",
+			servers: []*ServerHealth{
+				{Address: "a", Leader: true, Healthy: true},
+				{Address: "b", Healthy: true},
+				{Address: "c", Healthy: true},
+				{Address: "d", FailedSince: failed},
+				{Address: "e", FailedSince: failed},
+			},
+			dead: []string{"d", "e"},
+		},
+		{
+			name: "non-voter",
+			servers: []*ServerHealth{
+				{Address: "a", Leader: true, Healthy: true},
+				{Address: "b", FailedSince: failed},
+				{Address: "c", FailedSince: failed},
+				{Address: "d", NonVoter: true, FailedSince: failed},
+			},
+			dead: []string{"d"},
+		},
+	}
+
+	for _, c := range cases {
+		health := &ClusterHealth{Servers: c.servers}
+		for _, s := range c.servers {
+			if !s.NonVoter {
+				health.Voters++
+				if s.Healthy {
+					health.HealthyVoters++
+				}
+			}
+		}
+
+		dead := health.deadServers(time.Minute, now)
+		if len(dead) != len(c.dead) {
+			t.Errorf("%s: expected %v to be removed, got %d servers", c.name, c.dead, len(dead))
+			continue
+		}
+		for i, s := range dead {
+			if s.Address != c.dead[i] {
+				t.Errorf("%s: expected %s to be removed, got: %s", c.name, c.dead[i], s.Address)
+			}
+		}
+	}
+}
+
+func TestClusterHealthOnFollower(t *testing.T) {
+	servers := testCluster(t, 2, nil)
+	ctx := testContext(t)
+
+	// The follower forwards the request, and the leader's error keeps its
+	// identity so that callers can tell autopilot is off.
+	if _, err := servers[1].ClusterHealth(ctx); err != ErrAutopilotDisabled {
+		t.Errorf("expected ErrAutopilotDisabled from the follower, got: %v", err)
+	}
+
+	// Autopilot refreshes its view periodically, so it may not have seen the
+	// second member yet.
+	servers = testCluster(t, 2, func(c *Config) { c.Autopilot = true })
+	waitFor(t, "the leader's view of 2 voters", func() bool {
+		health, err := servers[1].ClusterHealth(ctx)
+		return err == nil && health.Voters == 2 && len(health.Servers) == 2
+	})
+}
@@ -0,0 +1,215 @@
+package blehdb
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// bootstrapRetryInterval is how long to wait between attempts to hand the
+// expected peer set to a member that could not be reached.
+const bootstrapRetryInterval = time.Second
+
+// expectBootstrap collects members joining a node started with
+// Config.BootstrapExpect until enough are known to form the cluster.
+type expectBootstrap struct {
+	expect int
+
+	lock  sync.Mutex
+	peers map[string]*JoinRequest
+	done  bool
+}
+
+func newExpectBootstrap(expect int, self *JoinRequest) *expectBootstrap {
+	return &expectBootstrap{
+		expect: expect,
+		peers: map[string]*JoinRequest{
+			self.ID: self,
+		},
+	}
+}
+
+// add records a joining member. It returns false once the cluster has been
+// formed, in which case the join must go through raft. When the expected
+// number of members is reached the full peer set, keyed by server ID, is
+// returned.
+func (e *expectBootstrap) add(args *JoinRequest) (bool, map[string]*JoinRequest) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.done {
+		return false, nil
+	}
+
+	e.peers[joinID(args)] = args
+	if len(e.peers) < e.expect {
+		return true, nil
+	}
+
+	e.done = true
+
+	peers := make(map[string]*JoinRequest)
+	for k, v := range e.peers {
+		peers[k] = v
+	}
+
+	return true, peers
+}
+
+// known returns the raft addresses of the members collected so far.
+func (e *expectBootstrap) known() []string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	var addrs []string
+	for _, p := range e.peers {
+		addrs = append(addrs, p.Address)
+	}
+	sort.Strings(addrs)
+
+	return addrs
+}
+
+// finish marks the cluster as formed without going through add, for example
+// when this member was bootstrapped by another.
+func (e *expectBootstrap) finish() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.done = true
+}
+
+// handleExpectJoin records a join while waiting for BootstrapExpect members.
+// It returns false when the join should be handled by raft instead.
+func (s *Server) handleExpectJoin(args *JoinRequest) bool {
+	if s.expect == nil || s.raft.Leader() != "" {
+		return false
+	}
+
+	ok, peers := s.expect.add(args)
+	if !ok {
+		return false
+	}
+
+	s.logger.Printf("Waiting for %d peers before bootstrapping, %s joined", s.expect.expect, args.Address)
+	if peers != nil {
+		go s.bootstrapExpected(peers)
+	}
+
+	return true
+}
+
+// bootstrapExpected forms the cluster from the collected peers. Every member
+// is bootstrapped with the same configuration, after which a regular election
+// takes place.
+func (s *Server) bootstrapExpected(peers map[string]*JoinRequest) {
+	var ids []string
+	for id := range peers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var servers []raft.Server
+	for _, id := range ids {
+		servers = append(servers, raft.Server{
+			Suffrage: raft.Voter,
+			ID:       raft.ServerID(id),
+			Address:  raft.ServerAddress(peers[id].Address),
+		})
+	}
+
+	s.logger.Printf("Expected peers are known, bootstrapping cluster with %v", ids)
+
+	for _, id := range ids {
+		if id == s.id {
+			continue
+		}
+
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), rpcDialTimeout)
+			var reply string
+			err := s.callRPC(ctx, peers[id].RPCAddress, "Management.Bootstrap", &BootstrapRequest{Servers: servers}, &reply)
+			cancel()
+			if err == nil {
+				break
+			}
+
+			s.logger.Printf("error bootstrapping %s, retrying: %v", id, err)
+			select {
+			case <-time.After(bootstrapRetryInterval):
+			case <-s.shutdownCh:
+				return
+			}
+		}
+	}
+
+	if err := s.raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil {
+		s.logger.Printf("error bootstrapping cluster: %v", err)
+		return
+	}
+
+	// Record every member's RPC address once a leader has been elected.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	for _, id := range ids {
+		if _, err := s.addPeer(ctx, peers[id]); err != nil {
+			s.logger.Printf("error registering %s: %v", id, err)
+		}
+	}
+}
+
+// bootstrapPeers bootstraps the configuration handed over by the member that
+// collected the expected joins.
+func (s *Server) bootstrapPeers(servers []raft.Server) error {
+	if s.expect == nil {
+		return fmt.Errorf("this member is not waiting to be bootstrapped")
+	}
+
+	s.expect.finish()
+
+	err := s.raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error()
+	if err != raft.ErrCantBootstrap {
+		return err
+	}
+
+	// A retried request finds the same configuration already in place; any
+	// other configuration means this member belongs to a different cluster.
+	existing, err := s.servers()
+	if err != nil {
+		return err
+	}
+
+	if !sameServers(existing, servers) {
+		return fmt.Errorf("already bootstrapped with a different configuration: %v", serverAddrs(existing))
+	}
+
+	return nil
+}
+
+// sameServers reports whether a and b hold the same servers in any order.
+func sameServers(a, b []raft.Server) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for _, srv := range a {
+		found := false
+		for _, other := range b {
+			if srv == other {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,104 @@
+package blehdb
+
+import (
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestExpectBootstrap(t *testing.T) {
+	e := newExpectBootstrap(3, &JoinRequest{ID: "node1", Address: "10.0.0.1:11000", RPCAddress: "10.0.0.1:12000"})
+
+	ok, peers := e.add(&JoinRequest{ID: "node2", Address: "10.0.0.2:11000", RPCAddress: "10.0.0.2:12000"})
+	if !ok || peers != nil {
+		t.Fatal("join should be recorded without forming the cluster")
+	}
+
+	if known := e.known(); len(known) != 2 || known[0] != "10.0.0.1:11000" {
+		t.Errorf("expected the two collected members in order, got: %v", known)
+	}
+
+	ok, peers = e.add(&JoinRequest{Address: "10.0.0.3:11000", RPCAddress: "10.0.0.3:12000"})
+	if !ok || len(peers) != 3 {
+		t.Fatalf("third member should form the cluster, got peers: %v", peers)
+	}
+
+	if p := peers["node1"]; p == nil || p.RPCAddress != "10.0.0.1:12000" {
+		t.Errorf("local member should be part of the peer set, got: %v", peers)
+	}
+
+	if peers["10.0.0.3:11000"] == nil {
+		t.Errorf("a member without an ID should be known by its address, got: %v", peers)
+	}
+
+	ok, _ = e.add(&JoinRequest{ID: "node4", Address: "10.0.0.4:11000", RPCAddress: "10.0.0.4:12000"})
+	if ok {
+		t.Error("joins after the cluster was formed should be handled by raft")
+	}
+}
+
+func TestBootstrapRestart(t *testing.T) {
+	config := testConfig(t)
+	config.Bootstrap = true
+
+	s := startServer(t, config)
+	waitForLeader(t, s)
+	ctx := testContext(t)
+
+	if _, err := s.CreateBucket(ctx, "foo"); err != nil {
+		t.Fatalf("error creating bucket: %v", err)
+	}
+	token, err := s.Set(ctx, "foo", "bar", "baz")
+	if err != nil {
+		t.Fatalf("error setting item: %v", err)
+	}
+	id := s.id
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("error closing server: %v", err)
+	}
+
+	// Bootstrap is still set, but the existing state must be used instead.
+	s = startServer(t, config)
+	waitForLeader(t, s)
+
+	if s.id != id {
+		t.Errorf("expected the server ID to survive a restart, got: '%s' then '%s'", id, s.id)
+	}
+
+	servers, err := s.servers()
+	if err != nil || len(servers) != 1 || string(servers[0].ID) != id {
+		t.Errorf("expected a configuration holding only this member, got: %v, %v", servers, err)
+	}
+
+	// The log is replayed after the election, so wait for the write.
+	val, _, err := s.Get(ctx, "foo", "bar", &ReadOptions{Token: token})
+	if err != nil || val != "baz" {
+		t.Errorf("expected data written before the restart, got: '%v', %v", val, err)
+	}
+
+	if _, err := s.Set(ctx, "foo", "bar", "qux"); err != nil {
+		t.Errorf("error writing after the restart: %v", err)
+	}
+}
+
+func TestBootstrapPeersExisting(t *testing.T) {
+	s := testServer(t, func(c *Config) { c.Bootstrap = true })
+	waitForLeader(t, s)
+
+	servers, err := s.servers()
+	if err != nil {
+		t.Fatalf("error reading configuration: %v", err)
+	}
+
+	// A retried request finds its own configuration in place.
+	s.expect = newExpectBootstrap(1, &JoinRequest{ID: s.id, Address: s.config.RaftAdvertise})
+	if err := s.bootstrapPeers(servers); err != nil {
+		t.Errorf("expected bootstrapping the same configuration to succeed, got: %v", err)
+	}
+
+	other := append([]raft.Server{{Suffrage: raft.Voter, ID: "other", Address: "10.0.0.2:11000"}}, servers...)
+	if err := s.bootstrapPeers(other); err == nil {
+		t.Error("expected bootstrapping a different configuration to fail")
+	}
+}
@@ -0,0 +1,168 @@
+package blehdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/raft"
+	"github.com/joshkrueger/blehdb/store"
+)
+
+const (
+	// bulkLoadIndex and bulkLoadTerm position a bulk loaded snapshot at the
+	// very start of the log so that regular entries follow on from it.
+	bulkLoadIndex = 1
+	bulkLoadTerm  = 1
+)
+
+// BulkLoad builds the initial state of a new cluster offline. It reads JSON
+// Lines in the format written by Export and stores the result as a raft
+// snapshot in config.StorageDir, without going through the raft log.
+//
+// BulkLoad must be run before the server is started, on a node without any
+// existing raft state. Once that node is started it restores the snapshot, and
+// members that join it receive the data through raft's snapshot install
+// instead of replaying a log entry per item. The number of loaded items is
+// returned.
+func BulkLoad(config *Config, r io.Reader) (int, error) {
+	if err := ValidateConfig(config); err != nil {
+		return 0, fmt.Errorf("Invalid Config: %v", err)
+	}
+
+	if hasExistingState(config.StorageDir) {
+		return 0, fmt.Errorf("%s already contains raft state, refusing to bulk load", config.StorageDir)
+	}
+
+	s, count, err := loadRecords(r)
+	if err != nil {
+		return count, err
+	}
+
+	storeBuf, err := s.Backup()
+	if err != nil {
+		return count, err
+	}
+
+	snap := &fsmSnapshot{
+		index: bulkLoadIndex,
+	}
+
+	snap.snap, err = json.Marshal(&fsmState{
+		Index:   bulkLoadIndex,
+		Store:   storeBuf,
+		Members: make(map[string]*member),
+	})
+	if err != nil {
+		return count, err
+	}
+
+	if config.KeyProvider != nil {
+		snap.keyring, err = newKeyring(config.KeyProvider)
+		if err != nil {
+			return count, fmt.Errorf("loading encryption keys: %v", err)
+		}
+	}
+
+	logger := log.New(os.Stdout, "[BULKLOAD] ", log.LstdFlags)
+	snapshots, err := raft.NewFileSnapshotStoreWithLogger(config.StorageDir, config.snapshotRetain(), raftLogger(logger))
+	if err != nil {
+		return count, err
+	}
+
+	// The snapshot carries a configuration holding only this member, so that
+	// it elects itself on start without being bootstrapped.
+	addr, err := advertiseAddr(config.RaftBind, config.RaftAdvertise)
+	if config.SinglePort {
+		addr, err = advertiseAddr(config.RPCBind, config.RPCAdvertise)
+	}
+	if err != nil {
+		return count, err
+	}
+
+	// A legacy member keeps its raft address as its ID, as it does when the
+	// server starts.
+	id, err := loadNodeID(config.StorageDir, addr)
+	if err != nil {
+		return count, fmt.Errorf("loading server ID: %v", err)
+	}
+
+	configuration := raft.Configuration{
+		Servers: []raft.Server{{
+			Suffrage: raft.Voter,
+			ID:       raft.ServerID(id),
+			Address:  raft.ServerAddress(addr),
+		}},
+	}
+
+	// The transport is only used to encode the configuration in the legacy
+	// peers format.
+	_, trans := raft.NewInmemTransport(raft.ServerAddress(addr))
+	defer trans.Close()
+
+	sink, err := snapshots.Create(raft.SnapshotVersionMax, bulkLoadIndex, bulkLoadTerm, configuration, bulkLoadIndex, trans)
+	if err != nil {
+		return count, err
+	}
+
+	if err := snap.Persist(sink); err != nil {
+		return count, err
+	}
+
+	logger.Printf("Loaded %d items into snapshot %s", count, sink.ID())
+
+	return count, nil
+}
+
+// hasExistingState reports whether dir already holds a raft log or snapshots.
+func hasExistingState(dir string) bool {
+	if _, err := os.Stat(filepath.Join(dir, "raft.db")); err == nil {
+		return true
+	}
+
+	snaps, _ := filepath.Glob(filepath.Join(dir, "snapshots", "*"))
+	return len(snaps) > 0
+}
+
+// loadRecords builds a store directly from JSON Lines export records.
+func loadRecords(r io.Reader) (*store.BlehStore, int, error) {
+	s := store.New()
+	dec := json.NewDecoder(r)
+	count := 0
+
+	for {
+		var rec ExportRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, count, fmt.Errorf("reading record %d: %v", count+1, err)
+		}
+
+		value, err := rec.decodeValue()
+		if err != nil {
+			return nil, count, err
+		}
+
+		if !s.BucketExists(rec.Bucket) {
+			if err := s.CreateBucket(rec.Bucket); err != nil {
+				return nil, count, err
+			}
+		}
+
+		if rec.Empty {
+			continue
+		}
+
+		if err := s.SetItem(rec.Bucket, rec.Key, value); err != nil {
+			return nil, count, err
+		}
+		count++
+	}
+
+	return s, count, nil
+}
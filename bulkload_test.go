@@ -0,0 +1,116 @@
+package blehdb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadRecords(t *testing.T) {
+	data := `{"bucket":"foo","key":"bar","value":"baz"}
+{"bucket":"foo","key":"qux","value":"/w==","encoding":"base64"}
+{"bucket":"other","key":"bar","value":"baz"}
+`
+
+	s, count, err := loadRecords(strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if count != 3 {
+		t.Errorf("expected 3 records, got: %v", count)
+	}
+
+	if !s.BucketExists("other") {
+		t.Error("bucket 'other' should have been created")
+	}
+
+	val, _ := s.GetItem("foo", "qux")
+	if val != "\xff" {
+		t.Errorf("base64 values should be decoded, got: '%v'", val)
+	}
+
+	_, _, err = loadRecords(strings.NewReader(`{"bucket":`))
+	if err == nil {
+		t.Error("malformed input should return an error")
+	}
+}
+
+func TestHasExistingState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blehdb-bulkload")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if hasExistingState(dir) {
+		t.Error("an empty directory should not have existing state")
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "raft.db"), nil, 0644)
+	if !hasExistingState(dir) {
+		t.Error("a directory with raft.db should have existing state")
+	}
+}
+
+func TestBulkLoadServer(t *testing.T) {
+	config := testConfig(t)
+
+	data := `{"bucket":"foo","key":"bar","value":"baz"}
+{"bucket":"empty","key":"","value":"","size":0,"empty":true}
+`
+	count, err := BulkLoad(config, strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("error bulk loading: %v", err)
+	}
+
+	if count != 1 {
+		t.Errorf("expected 1 item, got: %v", count)
+	}
+
+	// The loaded member elects itself without being bootstrapped.
+	s := startServer(t, config)
+	waitForLeader(t, s)
+	ctx := testContext(t)
+
+	val, _, err := s.Get(ctx, "foo", "bar", nil)
+	if err != nil || val != "baz" {
+		t.Errorf("expected the loaded item, got: '%v', %v", val, err)
+	}
+
+	if !s.BucketExists("empty") {
+		t.Error("bucket 'empty' should have been loaded")
+	}
+
+	// Regular entries follow on from the loaded snapshot.
+	if _, err := s.Set(ctx, "foo", "qux", "quux"); err != nil {
+		t.Fatalf("error setting item: %v", err)
+	}
+
+	val, _, err = s.Get(ctx, "foo", "qux", nil)
+	if err != nil || val != "quux" {
+		t.Errorf("expected the new item, got: '%v', %v", val, err)
+	}
+}
+
+func TestBulkLoadLegacyID(t *testing.T) {
+	config := testConfig(t)
+
+	// A legacy member keeps its raft address as its ID, as it would when
+	// the server starts.
+	peers := []byte(`["` + config.RaftBind + `"]`)
+	if err := ioutil.WriteFile(filepath.Join(config.StorageDir, legacyPeersFile), peers, 0644); err != nil {
+		t.Fatalf("error writing peers: %v", err)
+	}
+
+	if _, err := BulkLoad(config, strings.NewReader(`{"bucket":"foo","key":"bar","value":"baz"}`)); err != nil {
+		t.Fatalf("error bulk loading: %v", err)
+	}
+
+	id, err := loadNodeID(config.StorageDir, "")
+	if err != nil || id != config.RaftBind {
+		t.Errorf("expected the raft address as ID, got: '%s', %v", id, err)
+	}
+}
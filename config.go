@@ -1,6 +1,9 @@
 package blehdb
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 // Config provides the necessary configuration to the BlehDB server.
 type Config struct {
@@ -13,12 +16,156 @@ type Config struct {
 
 	// RPCBind specifies the bind address for the RPC server.
 	RPCBind string
+
+	// RaftAdvertise and RPCAdvertise are the addresses other members use to
+	// reach this one, for example the public side of a NAT. They default to
+	// the bind addresses, with a wildcard host such as ":11000" or
+	// "0.0.0.0:11000" replaced by a private IP of this host.
+	RaftAdvertise string
+	RPCAdvertise  string
+
+	// SinglePort serves raft on the RPC listener, so that only RPCBind needs
+	// to be reachable. Each connection starts with a byte naming its protocol.
+	// RaftBind and RaftAdvertise are unused, raft advertising the RPC address
+	// instead. It must be set on every member of the cluster, and cannot be
+	// turned on or off for a member that already has raft state: the stored
+	// cluster configuration keeps its old raft address, so such a member
+	// fails to start.
+	SinglePort bool
+
+	// ArchiveDir enables log archiving when set. Every committed log entry
+	// and every snapshot is copied into this directory, allowing state to be
+	// rebuilt at any earlier index or time with RecoverStore.
+	ArchiveDir string
+
+	// SnapshotInterval controls how often raft checks whether a snapshot
+	// should be taken.
+	SnapshotInterval time.Duration
+
+	// SnapshotThreshold is the number of log entries since the last snapshot
+	// that must accumulate before a new snapshot is taken.
+	SnapshotThreshold uint64
+
+	// TrailingLogs is the number of log entries left in the log store after a
+	// snapshot, so that slow followers can catch up without a full snapshot.
+	TrailingLogs uint64
+
+	// SnapshotRetain is the number of snapshots kept on disk. Zero keeps the
+	// default of 2.
+	SnapshotRetain int
+
+	// KeyProvider enables AES-GCM encryption of log entry payloads and
+	// snapshots when set. Rotated keys take effect for snapshots from the next
+	// snapshot onwards. A member that cannot decrypt a committed entry panics
+	// rather than diverge from the rest of the cluster.
+	KeyProvider KeyProvider
+
+	// Bootstrap allows this member to elect itself and form a new single node
+	// cluster. It should be set on exactly one member of a new cluster, and
+	// is ignored once the member has any raft state.
+	Bootstrap bool
+
+	// BootstrapExpect waits until this many members, including this one,
+	// have joined before forming a new cluster. It is an alternative to
+	// Bootstrap and is likewise ignored once the member has any raft state.
+	BootstrapExpect int
+
+	// RetryJoin lists the RPC addresses of existing members to join at
+	// startup. Each address is tried in turn, with backoff between rounds,
+	// until one accepts. Joining is idempotent, so it is safe to keep this set
+	// on members that already belong to the cluster.
+	RetryJoin []string
+
+	// Discoverer finds further members to join, in addition to RetryJoin. It
+	// is consulted before every round of join attempts.
+	Discoverer Discoverer
+
+	// NonVoter starts this member as a read replica. Replicas join the
+	// cluster through RetryJoin or the Discoverer as raft non-voters: they
+	// receive the committed log and serve stale and bounded-staleness reads,
+	// but take no part in elections or quorum.
+	NonVoter bool
+
+	// PromoteNonVoter makes a NonVoter ask to become a voter once it has
+	// caught up with the log. A promoted replica keeps its vote across
+	// restarts.
+	PromoteNonVoter bool
+
+	// LeaveOnShutdown makes Shutdown remove the member from the cluster
+	// before stopping, instead of leaving it behind as an unreachable peer.
+	LeaveOnShutdown bool
+
+	// Zone names the failure domain, such as a rack or availability zone,
+	// that this member runs in. Members with a zone follow the role chosen for
+	// them by a leader with ZonePlacement set.
+	Zone string
+
+	// ZonePlacement lets the leader choose which members vote so that losing
+	// any one zone never costs quorum. Members in a zone with more than its
+	// share of voters are demoted to non-voters, and promoted again once
+	// they are needed. It requires every member to set Zone.
+	ZonePlacement bool
+
+	// Autopilot runs a health check loop on the leader. It tracks how far
+	// each member trails the log and when it last heard from the leader,
+	// removes members that have been unhealthy for DeadServerThreshold, and
+	// holds back the promotion of replicas until they have been healthy for
+	// ServerStabilizationTime.
+	Autopilot bool
+
+	// AutopilotInterval is how often autopilot checks the cluster's health.
+	AutopilotInterval time.Duration
+
+	// LastContactThreshold is how long a member may go without hearing from
+	// the leader before autopilot considers it unhealthy.
+	LastContactThreshold time.Duration
+
+	// MaxTrailingLogs is how many entries a member may trail the leader's log
+	// by before autopilot considers it unhealthy.
+	MaxTrailingLogs uint64
+
+	// DeadServerThreshold is how long a member must have been unhealthy
+	// before autopilot removes it from the cluster.
+	DeadServerThreshold time.Duration
+
+	// ServerStabilizationTime is how long a replica must have been healthy
+	// before autopilot lets it be promoted to a voter.
+	ServerStabilizationTime time.Duration
+
+	// GossipBind enables a SWIM-style gossip layer on this address. Members
+	// discover each other through gossip, and the leader adds members that
+	// gossip reports alive and removes those it has reported failed for
+	// DeadServerThreshold.
+	GossipBind string
+
+	// GossipJoin lists the gossip addresses of existing members. Any one of
+	// them is enough to discover the rest of the cluster.
+	GossipJoin []string
+
+	// ClusterName is gossiped by every member. The leader only adds members
+	// gossiping the same name, so that a GossipJoin pointing at another
+	// cluster does not merge the two.
+	ClusterName string
 }
 
+// defaultSnapshotRetain is the number of snapshots kept when SnapshotRetain
+// is not set.
+const defaultSnapshotRetain = 2
+
 func DefaultConfig() *Config {
 	return &Config{
-		RaftBind: ":11000",
-		RPCBind:  ":12000",
+		RaftBind:          ":11000",
+		RPCBind:           ":12000",
+		SnapshotInterval:  120 * time.Second,
+		SnapshotThreshold: 8192,
+		TrailingLogs:      10240,
+		SnapshotRetain:    defaultSnapshotRetain,
+
+		AutopilotInterval:       10 * time.Second,
+		LastContactThreshold:    5 * time.Second,
+		MaxTrailingLogs:         256,
+		DeadServerThreshold:     5 * time.Minute,
+		ServerStabilizationTime: 10 * time.Second,
 	}
 }
 
@@ -27,5 +174,50 @@ func ValidateConfig(config *Config) error {
 		return fmt.Errorf("A StorageDir must be specified")
 	}
 
+	if config.Bootstrap && config.BootstrapExpect > 0 {
+		return fmt.Errorf("Bootstrap and BootstrapExpect cannot both be set")
+	}
+
+	if config.BootstrapExpect < 0 {
+		return fmt.Errorf("BootstrapExpect cannot be negative")
+	}
+
+	if config.NonVoter && len(config.RetryJoin) == 0 && config.Discoverer == nil {
+		return fmt.Errorf("NonVoter requires at least one RetryJoin address or a Discoverer")
+	}
+
+	if config.NonVoter && (config.Bootstrap || config.BootstrapExpect > 0) {
+		return fmt.Errorf("a NonVoter cannot bootstrap a cluster")
+	}
+
+	if config.SinglePort && config.RaftAdvertise != "" {
+		return fmt.Errorf("RaftAdvertise cannot be set with SinglePort")
+	}
+
+	if config.SnapshotRetain < 0 {
+		return fmt.Errorf("SnapshotRetain cannot be negative")
+	}
+
+	if config.ZonePlacement && config.Zone == "" {
+		return fmt.Errorf("ZonePlacement requires a Zone")
+	}
+
+	if len(config.GossipJoin) > 0 && config.GossipBind == "" {
+		return fmt.Errorf("GossipJoin requires a GossipBind")
+	}
+
+	if config.Autopilot && config.AutopilotInterval <= 0 {
+		return fmt.Errorf("Autopilot requires a positive AutopilotInterval")
+	}
+
 	return nil
 }
+
+// snapshotRetain returns the number of snapshots to keep on disk.
+func (c *Config) snapshotRetain() int {
+	if c.SnapshotRetain == 0 {
+		return defaultSnapshotRetain
+	}
+
+	return c.SnapshotRetain
+}
@@ -23,4 +23,58 @@ func TestValidateConfig(t *testing.T) {
 	if err != nil {
 		t.Error("a valid configuration should have have returned an error")
 	}
+
+	c.SnapshotRetain = -1
+	err = ValidateConfig(c)
+	if err == nil {
+		t.Error("should have returned an error when SnapshotRetain is negative")
+	}
+
+	c.SnapshotRetain = 0
+	err = ValidateConfig(c)
+	if err != nil {
+		t.Errorf("a zero SnapshotRetain should fall back to the default, got: %v", err)
+	}
+
+	if c.snapshotRetain() != defaultSnapshotRetain {
+		t.Errorf("expected the default SnapshotRetain, got: %v", c.snapshotRetain())
+	}
+	c.SnapshotRetain = 2
+
+	c.Bootstrap = true
+	c.BootstrapExpect = 3
+	err = ValidateConfig(c)
+	if err == nil {
+		t.Error("should have returned an error when both bootstrap modes are set")
+	}
+	c.Bootstrap = false
+	c.BootstrapExpect = 0
+
+	c.GossipJoin = []string{"10.0.0.1:13000"}
+	err = ValidateConfig(c)
+	if err == nil {
+		t.Error("should have returned an error when GossipJoin has no GossipBind")
+	}
+	c.GossipJoin = nil
+
+	c.ZonePlacement = true
+	err = ValidateConfig(c)
+	if err == nil {
+		t.Error("should have returned an error when ZonePlacement has no Zone")
+	}
+	c.ZonePlacement = false
+
+	c.Autopilot = true
+	c.AutopilotInterval = 0
+	err = ValidateConfig(c)
+	if err == nil {
+		t.Error("should have returned an error when Autopilot has no interval")
+	}
+	c.Autopilot = false
+
+	c.NonVoter = true
+	err = ValidateConfig(c)
+	if err == nil {
+		t.Error("should have returned an error when a NonVoter has no RetryJoin addresses")
+	}
 }
@@ -0,0 +1,144 @@
+package blehdb
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Discoverer finds the RPC addresses of existing members to join. It is asked
+// again on every join attempt, so providers may return different addresses as
+// the cluster changes.
+type Discoverer interface {
+	Discover(ctx context.Context) ([]string, error)
+}
+
+// DiscovererFunc adapts a function to the Discoverer interface.
+type DiscovererFunc func(ctx context.Context) ([]string, error)
+
+func (f DiscovererFunc) Discover(ctx context.Context) ([]string, error) {
+	return f(ctx)
+}
+
+// StaticDiscoverer returns a fixed list of addresses.
+type StaticDiscoverer []string
+
+func (d StaticDiscoverer) Discover(ctx context.Context) ([]string, error) {
+	return d, nil
+}
+
+// FileDiscoverer reads addresses from a file containing one address per line.
+// Blank lines and lines starting with '#' are ignored. The file is not
+// watched; it is read again on every join attempt, so edits take effect from
+// the next attempt without a restart.
+type FileDiscoverer struct {
+	Path string
+}
+
+func (d *FileDiscoverer) Discover(ctx context.Context) ([]string, error) {
+	b, err := ioutil.ReadFile(d.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []string
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if _, _, err := net.SplitHostPort(line); err != nil {
+			return nil, fmt.Errorf("invalid address '%s' in %s: %v", line, d.Path, err)
+		}
+		addrs = append(addrs, line)
+	}
+
+	return addrs, nil
+}
+
+// DNSDiscoverer looks addresses up in DNS. With SRV set, Name is looked up as
+// an SRV record, such as "_blehdb._tcp.example.com", and each target is
+// joined on the port it advertises. Otherwise Name is resolved to A and AAAA
+// records, each joined on Port. Either way the addresses are returned sorted,
+// so that every member tries them in the same order.
+type DNSDiscoverer struct {
+	Name string
+	Port int
+	SRV  bool
+
+	// Resolver is used for lookups when set, for example to query a
+	// particular DNS server. Otherwise the system resolver is used.
+	Resolver *net.Resolver
+}
+
+func (d *DNSDiscoverer) Discover(ctx context.Context) ([]string, error) {
+	r := d.Resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+
+	var addrs []string
+	if d.SRV {
+		_, records, err := r.LookupSRV(ctx, "", "", d.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, srv := range records {
+			host := strings.TrimSuffix(srv.Target, ".")
+			addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(int(srv.Port))))
+		}
+		sort.Strings(addrs)
+
+		return addrs, nil
+	}
+
+	if d.Port == 0 {
+		return nil, fmt.Errorf("DNSDiscoverer for '%s' needs a Port unless SRV is set", d.Name)
+	}
+
+	hosts, err := r.LookupHost(ctx, d.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, host := range hosts {
+		addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(d.Port)))
+	}
+	sort.Strings(addrs)
+
+	return addrs, nil
+}
+
+// joinAddrs returns the addresses to try joining: Config.RetryJoin followed by
+// whatever Config.Discoverer finds, without duplicates. A discovery failure is
+// logged and the static addresses are still returned.
+func (s *Server) joinAddrs(ctx context.Context) []string {
+	seen := make(map[string]bool)
+	var addrs []string
+	add := func(list []string) {
+		for _, addr := range list {
+			if !seen[addr] {
+				seen[addr] = true
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+
+	add(s.config.RetryJoin)
+
+	if s.config.Discoverer != nil {
+		found, err := s.config.Discoverer.Discover(ctx)
+		if err != nil {
+			s.logger.Printf("error discovering members: %v", err)
+		}
+		add(found)
+	}
+
+	return addrs
+}
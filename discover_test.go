@@ -0,0 +1,212 @@
+package blehdb
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFileDiscoverer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blehdb-discover")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "peers")
+	d := &FileDiscoverer{Path: path}
+
+	if _, err := d.Discover(context.Background()); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+
+	ioutil.WriteFile(path, []byte("# seeds\n10.0.0.1:12000\n\n  10.0.0.2:12000  \n"), 0644)
+	addrs, err := d.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("error discovering: %v", err)
+	}
+	if !reflect.DeepEqual(addrs, []string{"10.0.0.1:12000", "10.0.0.2:12000"}) {
+		t.Errorf("unexpected addresses: %v", addrs)
+	}
+
+	ioutil.WriteFile(path, []byte("10.0.0.3:12000\n"), 0644)
+	addrs, _ = d.Discover(context.Background())
+	if !reflect.DeepEqual(addrs, []string{"10.0.0.3:12000"}) {
+		t.Errorf("expected changes to the file to be picked up, got: %v", addrs)
+	}
+
+	ioutil.WriteFile(path, []byte("10.0.0.3\n"), 0644)
+	if _, err := d.Discover(context.Background()); err == nil {
+		t.Error("expected an error for an address without a port")
+	}
+}
+
+const (
+	dnsTypeA   = 1
+	dnsTypeSRV = 33
+)
+
+// dnsRecord is an answer served by the DNS stand-in.
+type dnsRecord struct {
+	typ    uint16
+	ip     net.IP
+	port   uint16
+	target string
+}
+
+// serveDNS runs a minimal DNS server on a local UDP port that answers from
+// records, keyed by lower case question name, until the test ends. It returns
+// a resolver that queries it.
+func serveDNS(t *testing.T, records map[string][]dnsRecord) *net.Resolver {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := dnsAnswer(buf[:n], records); resp != nil {
+				conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", conn.LocalAddr().String())
+		},
+	}
+}
+
+func encodeDNSName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func dnsAnswer(query []byte, records map[string][]dnsRecord) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+
+	// Read the question name.
+	var labels []string
+	i := 12
+	for i < len(query) && query[i] != 0 {
+		l := int(query[i])
+		if i+1+l > len(query) {
+			return nil
+		}
+		labels = append(labels, string(query[i+1:i+1+l]))
+		i += 1 + l
+	}
+	if i+5 > len(query) {
+		return nil
+	}
+	question := query[12 : i+5]
+	qtype := binary.BigEndian.Uint16(query[i+1:])
+	name := strings.ToLower(strings.Join(labels, ".")) + "."
+
+	var answers [][]byte
+	for _, r := range records[name] {
+		if r.typ != qtype {
+			continue
+		}
+
+		var rdata []byte
+		switch r.typ {
+		case dnsTypeA:
+			rdata = r.ip.To4()
+		case dnsTypeSRV:
+			rdata = make([]byte, 6)
+			binary.BigEndian.PutUint16(rdata[4:], r.port)
+			rdata = append(rdata, encodeDNSName(r.target)...)
+		}
+
+		rr := []byte{0xc0, 12}
+		rr = append(rr, byte(r.typ>>8), byte(r.typ), 0, 1, 0, 0, 0, 60)
+		rr = append(rr, byte(len(rdata)>>8), byte(len(rdata)))
+		answers = append(answers, append(rr, rdata...))
+	}
+
+	resp := make([]byte, 12)
+	copy(resp, query[:2])
+	binary.BigEndian.PutUint16(resp[2:], 0x8180)
+	binary.BigEndian.PutUint16(resp[4:], 1)
+	binary.BigEndian.PutUint16(resp[6:], uint16(len(answers)))
+	resp = append(resp, question...)
+	for _, a := range answers {
+		resp = append(resp, a...)
+	}
+
+	return resp
+}
+
+func TestDNSDiscoverer(t *testing.T) {
+	resolver := serveDNS(t, map[string][]dnsRecord{
+		"blehdb.test.": {
+			{typ: dnsTypeA, ip: net.ParseIP("10.0.0.2")},
+			{typ: dnsTypeA, ip: net.ParseIP("10.0.0.1")},
+		},
+		"_blehdb._tcp.blehdb.test.": {
+			{typ: dnsTypeSRV, port: 12002, target: "node2.blehdb.test."},
+			{typ: dnsTypeSRV, port: 12001, target: "node1.blehdb.test."},
+		},
+	})
+
+	d := &DNSDiscoverer{Name: "blehdb.test.", Port: 12000, Resolver: resolver}
+	addrs, err := d.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("error discovering A records: %v", err)
+	}
+	if !reflect.DeepEqual(addrs, []string{"10.0.0.1:12000", "10.0.0.2:12000"}) {
+		t.Errorf("unexpected addresses: %v", addrs)
+	}
+
+	d = &DNSDiscoverer{Name: "_blehdb._tcp.blehdb.test.", SRV: true, Resolver: resolver}
+	addrs, err = d.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("error discovering SRV records: %v", err)
+	}
+	if !reflect.DeepEqual(addrs, []string{"node1.blehdb.test:12001", "node2.blehdb.test:12002"}) {
+		t.Errorf("unexpected addresses: %v", addrs)
+	}
+
+	d = &DNSDiscoverer{Name: "blehdb.test.", Resolver: resolver}
+	if _, err := d.Discover(context.Background()); err == nil {
+		t.Error("expected an error for an A lookup without a port")
+	}
+}
+
+func TestJoinAddrs(t *testing.T) {
+	s := &Server{
+		config: &Config{
+			RetryJoin: []string{"10.0.0.1:12000"},
+			Discoverer: DiscovererFunc(func(ctx context.Context) ([]string, error) {
+				return []string{"10.0.0.2:12000", "10.0.0.1:12000"}, nil
+			}),
+		},
+	}
+
+	addrs := s.joinAddrs(context.Background())
+	if !reflect.DeepEqual(addrs, []string{"10.0.0.1:12000", "10.0.0.2:12000"}) {
+		t.Errorf("unexpected addresses: %v", addrs)
+	}
+}
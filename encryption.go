@@ -0,0 +1,255 @@
+package blehdb
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// snapshotMagic prefixes encrypted snapshots so they can be told apart from
+// plaintext snapshots written before encryption was enabled.
+var snapshotMagic = []byte("BLEHENC1")
+
+// KeyProvider supplies the AES keys used to encrypt data at rest. New data is
+// always encrypted with the active key; the remaining keys are only used to
+// decrypt data written before a rotation.
+type KeyProvider interface {
+	// Keys returns the ID of the active key and every known key by ID. Keys
+	// must be 16, 24 or 32 bytes long to select AES-128, AES-192 or AES-256.
+	Keys() (active string, keys map[string][]byte, err error)
+}
+
+// FileKeyProvider reads keys from a file containing one "<id>:<base64 key>"
+// entry per line. The first entry is the active key. The file is re-read
+// whenever keys are reloaded, so rotating is a matter of prepending a new key.
+type FileKeyProvider struct {
+	Path string
+}
+
+func (p *FileKeyProvider) Keys() (string, map[string][]byte, error) {
+	b, err := ioutil.ReadFile(p.Path)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return parseKeys(string(b))
+}
+
+// EnvKeyProvider reads keys from an environment variable holding a comma
+// separated list of "<id>:<base64 key>" entries. The first entry is the active
+// key.
+type EnvKeyProvider struct {
+	Name string
+}
+
+func (p *EnvKeyProvider) Keys() (string, map[string][]byte, error) {
+	v := os.Getenv(p.Name)
+	if v == "" {
+		return "", nil, fmt.Errorf("environment variable '%s' is not set", p.Name)
+	}
+
+	return parseKeys(v)
+}
+
+func parseKeys(s string) (string, map[string][]byte, error) {
+	entries := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r'
+	})
+
+	var active string
+	keys := make(map[string][]byte)
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return "", nil, fmt.Errorf("invalid key entry, expected '<id>:<base64 key>'")
+		}
+
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid key '%s': %v", parts[0], err)
+		}
+
+		if active == "" {
+			active = parts[0]
+		}
+		keys[parts[0]] = key
+	}
+
+	if active == "" {
+		return "", nil, fmt.Errorf("no keys found")
+	}
+
+	return active, keys, nil
+}
+
+// keyring encrypts and decrypts payloads with AES-GCM using the keys supplied
+// by a KeyProvider. Each ciphertext is prefixed with the ID of the key that
+// produced it.
+type keyring struct {
+	provider KeyProvider
+
+	lock   sync.RWMutex
+	active string
+	aeads  map[string]cipher.AEAD
+}
+
+func newKeyring(provider KeyProvider) (*keyring, error) {
+	k := &keyring{
+		provider: provider,
+	}
+
+	if err := k.reload(); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// reload fetches the keys from the provider again, picking up rotations.
+func (k *keyring) reload() error {
+	active, keys, err := k.provider.Keys()
+	if err != nil {
+		return err
+	}
+
+	if _, ok := keys[active]; !ok {
+		return fmt.Errorf("active key '%s' is missing", active)
+	}
+
+	aeads := make(map[string]cipher.AEAD)
+	for id, key := range keys {
+		if len(id) > 255 {
+			return fmt.Errorf("key id '%s' is too long", id)
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return fmt.Errorf("key '%s': %v", id, err)
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return fmt.Errorf("key '%s': %v", id, err)
+		}
+
+		aeads[id] = aead
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	k.active = active
+	k.aeads = aeads
+
+	return nil
+}
+
+func (k *keyring) encrypt(plain []byte) ([]byte, error) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+
+	aead := k.aeads[k.active]
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 0, 1+len(k.active)+len(nonce)+len(plain)+aead.Overhead())
+	buf = append(buf, byte(len(k.active)))
+	buf = append(buf, k.active...)
+	buf = append(buf, nonce...)
+
+	return aead.Seal(buf, nonce, plain, nil), nil
+}
+
+func (k *keyring) decrypt(buf []byte) ([]byte, error) {
+	if len(buf) < 1 || len(buf) < 1+int(buf[0]) {
+		return nil, fmt.Errorf("encrypted payload is truncated")
+	}
+
+	id := string(buf[1 : 1+buf[0]])
+	buf = buf[1+buf[0]:]
+
+	aead, err := k.aead(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(buf) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted payload is truncated")
+	}
+
+	return aead.Open(nil, buf[:aead.NonceSize()], buf[aead.NonceSize():], nil)
+}
+
+func (k *keyring) aead(id string) (cipher.AEAD, error) {
+	k.lock.RLock()
+	aead, ok := k.aeads[id]
+	k.lock.RUnlock()
+
+	if ok {
+		return aead, nil
+	}
+
+	// The key may have been added to the provider since we last loaded it.
+	if err := k.reload(); err != nil {
+		return nil, err
+	}
+
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+
+	aead, ok = k.aeads[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key '%s'", id)
+	}
+
+	return aead, nil
+}
+
+// encryptMessage wraps an encoded log message in an encrypted envelope.
+func (k *keyring) encryptMessage(msg []byte) ([]byte, error) {
+	ct, err := k.encrypt(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{uint8(EncryptedRequestType)}, ct...), nil
+}
+
+func (k *keyring) encryptSnapshot(snap []byte) ([]byte, error) {
+	ct, err := k.encrypt(snap)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(append([]byte{}, snapshotMagic...), ct...), nil
+}
+
+// decryptSnapshot returns the plaintext of a snapshot. Snapshots that were
+// written without encryption are returned as-is.
+func (k *keyring) decryptSnapshot(snap []byte) ([]byte, error) {
+	if !bytes.HasPrefix(snap, snapshotMagic) {
+		return snap, nil
+	}
+
+	if k == nil {
+		return nil, fmt.Errorf("snapshot is encrypted but no key provider is configured")
+	}
+
+	return k.decrypt(snap[len(snapshotMagic):])
+}
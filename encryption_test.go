@@ -0,0 +1,213 @@
+package blehdb
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+type staticKeys struct {
+	active string
+	keys   map[string][]byte
+}
+
+func (s *staticKeys) Keys() (string, map[string][]byte, error) {
+	return s.active, s.keys, nil
+}
+
+func testKeys() *staticKeys {
+	return &staticKeys{
+		active: "one",
+		keys: map[string][]byte{
+			"one": bytes.Repeat([]byte{1}, 32),
+		},
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	k1 := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 16))
+	k2 := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+
+	active, keys, err := parseKeys("new:" + k2 + "\n# retired\nold:" + k1 + "\n")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if active != "new" || len(keys) != 2 {
+		t.Errorf("expected active key 'new' and 2 keys, got: '%v' and %d keys", active, len(keys))
+	}
+
+	if _, _, err := parseKeys("nokey"); err == nil {
+		t.Error("malformed entries should return an error")
+	}
+
+	if _, _, err := parseKeys(""); err == nil {
+		t.Error("an empty key list should return an error")
+	}
+}
+
+func TestEnvKeyProvider(t *testing.T) {
+	k := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	os.Setenv("BLEHDB_TEST_KEYS", "a:"+k+",b:"+k)
+	defer os.Unsetenv("BLEHDB_TEST_KEYS")
+
+	p := &EnvKeyProvider{Name: "BLEHDB_TEST_KEYS"}
+	active, keys, err := p.Keys()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if active != "a" || len(keys) != 2 {
+		t.Errorf("expected active key 'a' and 2 keys, got: '%v' and %d keys", active, len(keys))
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	keys := testKeys()
+	k, err := newKeyring(keys)
+	if err != nil {
+		t.Fatalf("error creating keyring: %v", err)
+	}
+
+	old, err := k.encrypt([]byte("foo"))
+	if err != nil {
+		t.Fatalf("error encrypting: %v", err)
+	}
+
+	keys.keys["two"] = bytes.Repeat([]byte{2}, 32)
+	keys.active = "two"
+	if err := k.reload(); err != nil {
+		t.Fatalf("error reloading keys: %v", err)
+	}
+
+	plain, err := k.decrypt(old)
+	if err != nil {
+		t.Fatalf("data encrypted with a retired key should still decrypt: %v", err)
+	}
+
+	if string(plain) != "foo" {
+		t.Errorf("expected 'foo', got: '%s'", plain)
+	}
+
+	delete(keys.keys, "one")
+	k.reload()
+	if _, err := k.decrypt(old); err == nil {
+		t.Error("decrypting with a removed key should return an error")
+	}
+}
+
+func TestApplyEncrypted(t *testing.T) {
+	fsm := setupFSM(t)
+
+	var err error
+	fsm.keyring, err = newKeyring(testKeys())
+	if err != nil {
+		t.Fatalf("error creating keyring: %v", err)
+	}
+
+	msg, err := encodeMessage(CreateBucketRequestType, &command{Bucket: "foo"})
+	if err != nil {
+		t.Fatalf("error encoding message: %v", err)
+	}
+
+	msg, err = fsm.keyring.encryptMessage(msg)
+	if err != nil {
+		t.Fatalf("error encrypting message: %v", err)
+	}
+
+	if bytes.Contains(msg, []byte("foo")) {
+		t.Error("encrypted message should not contain the plaintext bucket name")
+	}
+
+	if resp := fsm.Apply(mockLog(msg)); resp != nil {
+		t.Fatalf("error applying raft log: %v", resp)
+	}
+
+	if !fsm.Store().BucketExists("foo") {
+		t.Error("bucket 'foo' should exist")
+	}
+}
+
+func TestApplyUndecryptable(t *testing.T) {
+	fsm := setupFSM(t)
+
+	keyring, err := newKeyring(testKeys())
+	if err != nil {
+		t.Fatalf("error creating keyring: %v", err)
+	}
+
+	msg, err := encodeMessage(CreateBucketRequestType, &command{Bucket: "foo"})
+	if err != nil {
+		t.Fatalf("error encoding message: %v", err)
+	}
+
+	msg, err = keyring.encryptMessage(msg)
+	if err != nil {
+		t.Fatalf("error encrypting message: %v", err)
+	}
+
+	applyPanics := func() (panicked bool) {
+		defer func() { panicked = recover() != nil }()
+		fsm.Apply(mockLog(msg))
+		return false
+	}
+
+	if !applyPanics() {
+		t.Error("applying an encrypted entry without keys should panic")
+	}
+
+	other := testKeys()
+	other.keys["one"] = bytes.Repeat([]byte{2}, 32)
+	fsm.keyring, err = newKeyring(other)
+	if err != nil {
+		t.Fatalf("error creating keyring: %v", err)
+	}
+
+	if !applyPanics() {
+		t.Error("applying an entry encrypted with an unknown key should panic")
+	}
+
+	if fsm.AppliedIndex() != 0 {
+		t.Errorf("an undecryptable entry should not be marked applied, got index %d", fsm.AppliedIndex())
+	}
+}
+
+func TestEncryptedSnapshot(t *testing.T) {
+	fsm := setupFSM(t)
+
+	var err error
+	fsm.keyring, err = newKeyring(testKeys())
+	if err != nil {
+		t.Fatalf("error creating keyring: %v", err)
+	}
+
+	fsm.Store().CreateBucket("foo")
+	fsm.Store().SetItem("foo", "bar", "baz")
+
+	snap, err := fsm.Snapshot()
+	if err != nil {
+		t.Fatalf("error taking snapshot: %v", err)
+	}
+
+	enc, err := fsm.keyring.encryptSnapshot(snap.(*fsmSnapshot).snap)
+	if err != nil {
+		t.Fatalf("error encrypting snapshot: %v", err)
+	}
+
+	restored := setupFSM(t)
+	if err := restored.Restore(ioutil.NopCloser(bytes.NewReader(enc))); err == nil {
+		t.Error("restoring an encrypted snapshot without keys should return an error")
+	}
+
+	restored.keyring = fsm.keyring
+	if err := restored.Restore(ioutil.NopCloser(bytes.NewReader(enc))); err != nil {
+		t.Fatalf("error restoring snapshot: %v", err)
+	}
+
+	val, _ := restored.Store().GetItem("foo", "bar")
+	if val != "baz" {
+		t.Errorf("value should be: 'baz', got: '%v'", val)
+	}
+}
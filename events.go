@@ -0,0 +1,192 @@
+package blehdb
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// eventBufferSize is the number of undelivered events buffered per
+// subscriber before further events are dropped.
+const eventBufferSize = 64
+
+type EventType uint8
+
+const (
+	// EventBecameLeader is sent when the local member becomes the leader.
+	EventBecameLeader EventType = iota
+
+	// EventLostLeadership is sent when the local member stops being the
+	// leader.
+	EventLostLeadership
+
+	// EventLeaderChanged is sent whenever the local member observes a new
+	// leader, or loses track of the leader, in which case Leader is empty.
+	EventLeaderChanged
+
+	// EventPeerAdded and EventPeerRemoved are sent when a member is added to
+	// or removed from the cluster. Every member receives them.
+	EventPeerAdded
+	EventPeerRemoved
+
+	// EventPeerPromoted and EventPeerDemoted are sent when a member becomes a
+	// voter or a non-voter.
+	EventPeerPromoted
+	EventPeerDemoted
+
+	// EventSnapshotTaken and EventSnapshotRestored are sent when the local
+	// FSM is snapshotted or restored from a snapshot.
+	EventSnapshotTaken
+	EventSnapshotRestored
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventBecameLeader:
+		return "BecameLeader"
+	case EventLostLeadership:
+		return "LostLeadership"
+	case EventLeaderChanged:
+		return "LeaderChanged"
+	case EventPeerAdded:
+		return "PeerAdded"
+	case EventPeerRemoved:
+		return "PeerRemoved"
+	case EventPeerPromoted:
+		return "PeerPromoted"
+	case EventPeerDemoted:
+		return "PeerDemoted"
+	case EventSnapshotTaken:
+		return "SnapshotTaken"
+	case EventSnapshotRestored:
+		return "SnapshotRestored"
+	default:
+		return "Unknown"
+	}
+}
+
+// Event is a leadership, membership or snapshot notification.
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	// Leader is set for leadership events.
+	Leader string
+
+	// Peer, Address and NonVoter are set for membership events. Peer is
+	// the member's server ID and Address its raft address.
+	Peer     string
+	Address  string
+	NonVoter bool
+
+	// Index is the raft index of membership and snapshot events.
+	Index uint64
+}
+
+// eventBroker fans events out to subscribers.
+type eventBroker struct {
+	lock   sync.Mutex
+	subs   map[chan Event]struct{}
+	closed bool
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{
+		subs: make(map[chan Event]struct{}),
+	}
+}
+
+func (b *eventBroker) subscribe() (<-chan Event, func()) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	ch := make(chan Event, eventBufferSize)
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+
+	b.subs[ch] = struct{}{}
+	return ch, func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// publish delivers e to every subscriber without blocking. It reports whether
+// any subscriber's buffer was full and the event had to be dropped for it.
+func (b *eventBroker) publish(e Event) bool {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	dropped := false
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			dropped = true
+		}
+	}
+
+	return dropped
+}
+
+// close closes every subscriber's channel.
+func (b *eventBroker) close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for ch := range b.subs {
+		close(ch)
+	}
+	b.subs = make(map[chan Event]struct{})
+	b.closed = true
+}
+
+// Subscribe returns a channel of cluster events along with a func that
+// cancels the subscription. Events are buffered, but a subscriber that falls
+// too far behind misses events rather than blocking the server. The channel is
+// closed when the subscription is cancelled or the server shuts down.
+func (s *Server) Subscribe() (<-chan Event, func()) {
+	return s.events.subscribe()
+}
+
+func (s *Server) publish(e Event) {
+	if s.events.publish(e) {
+		s.logger.Printf("WARNING: dropped %v event for a slow subscriber", e.Type)
+	}
+}
+
+// observeLeader publishes an event every time raft reports a leader change.
+func (s *Server) observeLeader() {
+	obsCh := make(chan raft.Observation, eventBufferSize)
+	observer := raft.NewObserver(obsCh, false, func(o *raft.Observation) bool {
+		_, ok := o.Data.(raft.LeaderObservation)
+		return ok
+	})
+
+	s.raft.RegisterObserver(observer)
+	defer s.raft.DeregisterObserver(observer)
+
+	for {
+		select {
+		case o := <-obsCh:
+			s.publish(Event{
+				Type:   EventLeaderChanged,
+				Leader: string(o.Data.(raft.LeaderObservation).Leader),
+			})
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package blehdb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEventBroker(t *testing.T) {
+	b := newEventBroker()
+
+	ch, cancel := b.subscribe()
+	other, _ := b.subscribe()
+
+	b.publish(Event{Type: EventBecameLeader, Leader: "127.0.0.1:11000"})
+
+	for _, c := range []<-chan Event{ch, other} {
+		e := <-c
+		if e.Type != EventBecameLeader || e.Leader != "127.0.0.1:11000" {
+			t.Fatalf("unexpected event: %+v", e)
+		}
+		if e.Time.IsZero() {
+			t.Error("expected event time to be set")
+		}
+	}
+
+	cancel()
+	if _, ok := <-ch; ok {
+		t.Error("expected cancelled subscription to be closed")
+	}
+
+	for i := 0; i < eventBufferSize; i++ {
+		if b.publish(Event{Type: EventLeaderChanged}) {
+			t.Fatalf("event %d dropped before the buffer was full", i)
+		}
+	}
+	if !b.publish(Event{Type: EventLeaderChanged}) {
+		t.Error("expected event to be dropped for a full subscriber")
+	}
+
+	b.close()
+	for range other {
+	}
+
+	late, _ := b.subscribe()
+	if _, ok := <-late; ok {
+		t.Error("expected subscription after close to be closed")
+	}
+}
+
+func TestFSMMemberEvents(t *testing.T) {
+	fsm := setupFSM(t)
+
+	var events []Event
+	fsm.notify = func(e Event) {
+		events = append(events, e)
+	}
+
+	m := &member{
+		RaftAddr: "127.0.0.1:11000",
+		RPCAddr:  "127.0.0.1:12000",
+	}
+
+	demoted := &member{
+		RaftAddr: m.RaftAddr,
+		RPCAddr:  m.RPCAddr,
+		NonVoter: true,
+		Demoted:  true,
+	}
+
+	msgs := []struct {
+		typ messageType
+		m   *member
+	}{
+		{RegisterMemberRequestType, m},
+		{RegisterMemberRequestType, m},
+		{RegisterMemberRequestType, demoted},
+		{RegisterMemberRequestType, m},
+		{DeregisterMemberRequestType, m},
+		{DeregisterMemberRequestType, m},
+	}
+
+	for _, c := range msgs {
+		msg, err := encodeMessage(c.typ, c.m)
+		if err != nil {
+			t.Fatalf("error encoding message: %v", err)
+		}
+		if resp := fsm.Apply(mockLog(msg)); resp != nil {
+			t.Fatalf("error applying raft log: %v", resp)
+		}
+	}
+
+	expected := []EventType{EventPeerAdded, EventPeerDemoted, EventPeerPromoted, EventPeerRemoved}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %v, got: %+v", expected, events)
+	}
+	for i, e := range events {
+		if e.Type != expected[i] || e.Peer != m.RaftAddr {
+			t.Errorf("expected %v event for %s, got: %+v", expected[i], m.RaftAddr, e)
+		}
+	}
+}
+
+// waitForEvent waits for an event on ch that matches, skipping any others.
+func waitForEvent(t *testing.T, ch <-chan Event, what string, match func(Event) bool) {
+	timeout := time.After(testWait)
+	for {
+		select {
+		case e := <-ch:
+			if match(e) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestLeadershipEvents(t *testing.T) {
+	servers := testCluster(t, 3, nil)
+	leader, target, other := servers[0], servers[1], servers[2]
+	ctx := testContext(t)
+
+	leaderCh, cancel := leader.Subscribe()
+	defer cancel()
+	targetCh, cancel := target.Subscribe()
+	defer cancel()
+	otherCh, cancel := other.Subscribe()
+	defer cancel()
+
+	if err := leader.TransferLeadership(ctx, target.id); err != nil {
+		t.Fatalf("error transferring leadership: %v", err)
+	}
+
+	waitForEvent(t, leaderCh, "the leader to lose leadership", func(e Event) bool {
+		return e.Type == EventLostLeadership
+	})
+	waitForEvent(t, targetCh, "the target to become leader", func(e Event) bool {
+		return e.Type == EventBecameLeader && e.Leader == target.config.RaftAdvertise
+	})
+	waitForEvent(t, otherCh, "the new leader to be observed", func(e Event) bool {
+		return e.Type == EventLeaderChanged && e.Leader == target.config.RaftAdvertise
+	})
+
+	// Shutting the leader down makes the rest elect one of themselves.
+	target.Close()
+	next := waitForLeader(t, leader, other)
+
+	nextCh, followerCh := leaderCh, otherCh
+	if next == other {
+		nextCh, followerCh = otherCh, leaderCh
+	}
+	waitForEvent(t, nextCh, "a remaining member to become leader", func(e Event) bool {
+		return e.Type == EventBecameLeader && e.Leader == next.config.RaftAdvertise
+	})
+	waitForEvent(t, followerCh, "the next leader to be observed", func(e Event) bool {
+		return e.Type == EventLeaderChanged && e.Leader == next.config.RaftAdvertise
+	})
+}
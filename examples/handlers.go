@@ -4,14 +4,24 @@ import (
 	"encoding/json"
 	"io"
 	"io/ioutil"
+	"log"
 	"net/http"
+	"time"
 
 	"goji.io/pat"
+
+	"github.com/joshkrueger/blehdb"
 )
 
+// tokenHeader carries consistency tokens from writes to subsequent reads.
+const tokenHeader = "X-BlehDB-Token"
+
 func handleStatus(w http.ResponseWriter, r *http.Request) {
-	status := make(map[string]string)
-	status["status"] = "ok"
+	status, err := db.Status()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 	b, _ := json.Marshal(status)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -19,16 +29,70 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 
 }
 
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	health, err := db.ClusterHealth(r.Context())
+	if err == blehdb.ErrAutopilotDisabled {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	b, _ := json.Marshal(health)
+	w.Header().Set("Content-Type", "application/json")
+	if health.Healthy {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}
+	w.Write(b)
+}
+
 func handleGetKey(w http.ResponseWriter, r *http.Request) {
 	bucket := pat.Param(r, "bucket")
 	key := pat.Param(r, "key")
 
-	v, err := db.Get(bucket, key)
+	opts := &blehdb.ReadOptions{}
+	switch r.URL.Query().Get("consistency") {
+	case "stale":
+		opts.Consistency = blehdb.ConsistencyStale
+	case "linearizable":
+		opts.Consistency = blehdb.ConsistencyLinearizable
+	}
+
+	if t := r.Header.Get(tokenHeader); t != "" {
+		token, err := blehdb.ParseConsistencyToken(t)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		opts.Token = token
+	}
+
+	if ms := r.URL.Query().Get("max_staleness"); ms != "" {
+		d, err := time.ParseDuration(ms)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		opts.Consistency = blehdb.ConsistencyStale
+		opts.MaxStaleness = d
+		opts.FailIfStale = r.URL.Query().Get("forward") == "false"
+	}
+
+	v, meta, err := db.Get(r.Context(), bucket, key, opts)
+	if err == blehdb.ErrTooStale {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("X-BlehDB-Staleness", meta.Staleness.String())
+
 	if v == "" {
 		w.WriteHeader(http.StatusNotFound)
 		return
@@ -50,41 +114,83 @@ func handleSetKey(w http.ResponseWriter, r *http.Request) {
 	}
 	val := string(body)
 
-	err = db.Set(bucket, key, val)
+	token, err := db.Set(r.Context(), bucket, key, val)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set(tokenHeader, token.String())
 }
 func handleDeleteKey(w http.ResponseWriter, r *http.Request) {
 	bucket := pat.Param(r, "bucket")
 	key := pat.Param(r, "key")
 
-	err := db.Delete(bucket, key)
+	token, err := db.Delete(r.Context(), bucket, key)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set(tokenHeader, token.String())
 }
 
 func handleCreateBucket(w http.ResponseWriter, r *http.Request) {
 	bucket := pat.Param(r, "bucket")
 
-	err := db.CreateBucket(bucket)
+	token, err := db.CreateBucket(r.Context(), bucket)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set(tokenHeader, token.String())
 }
 
 func handleDeleteBucket(w http.ResponseWriter, r *http.Request) {
 	bucket := pat.Param(r, "bucket")
 
-	err := db.DeleteBucket(bucket)
+	token, err := db.DeleteBucket(r.Context(), bucket)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(tokenHeader, token.String())
+}
+
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	buckets := r.URL.Query()["bucket"]
+	for _, b := range buckets {
+		if !db.BucketExists(b) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	err := db.Export(w, buckets...)
+	if err != nil {
+		log.Printf("export failed: %v", err)
+	}
+}
+
+func handleImport(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	n, token, err := db.Import(r.Context(), r.Body)
 	if err != nil {
+		log.Printf("import failed after %d items: %v", n, err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set(tokenHeader, token.String())
+
+	res := &struct {
+		Imported int `json:"imported"`
+	}{
+		Imported: n,
+	}
+	b, _ := json.Marshal(res)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
 }
 
 func handleListBuckets(w http.ResponseWriter, r *http.Request) {
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"time"
 
 	goji "goji.io"
 	"goji.io/pat"
@@ -26,12 +31,42 @@ var httpAddr string
 var raftAddr string
 var joinAddr string
 var rpcAddr string
+var raftAdvertise string
+var rpcAdvertise string
+var singlePort bool
+var bulkLoad string
+var leaveOnExit bool
+var bootstrap bool
+var bootstrapExpect int
+var nonVoter bool
+var autopilot bool
+var zone string
+var zonePlacement bool
+var gossipAddr string
+var gossipJoin string
+var clusterName string
+var discover string
 
 func init() {
 	flag.StringVar(&httpAddr, "addr", DefaultHTTPAddr, "Set the HTTP bind address")
 	flag.StringVar(&raftAddr, "raddr", DefaultRaftAddr, "Set the Raft bind address")
 	flag.StringVar(&rpcAddr, "rpcaddr", DefaultRPCAddr, "Set the BlehDB RPC bind address")
-	flag.StringVar(&joinAddr, "join", "", "Set the join address (optional)")
+	flag.StringVar(&raftAdvertise, "raftadv", "", "Set the Raft address advertised to other nodes (optional)")
+	flag.StringVar(&rpcAdvertise, "rpcadv", "", "Set the RPC address advertised to other nodes (optional)")
+	flag.BoolVar(&singlePort, "singleport", false, "Serve Raft on the RPC address instead of the Raft bind address")
+	flag.StringVar(&joinAddr, "join", "", "Set a comma separated list of join addresses (optional)")
+	flag.BoolVar(&bootstrap, "bootstrap", false, "Bootstrap a new cluster with this node as its first member")
+	flag.IntVar(&bootstrapExpect, "expect", 0, "Bootstrap a new cluster once this many nodes have joined")
+	flag.BoolVar(&nonVoter, "replica", false, "Run as a non-voting read replica of the -join addresses")
+	flag.BoolVar(&autopilot, "autopilot", false, "Remove dead nodes automatically while this node is the leader")
+	flag.StringVar(&zone, "zone", "", "Set the failure domain this node runs in (optional)")
+	flag.BoolVar(&zonePlacement, "zone-placement", false, "Spread voters across zones while this node is the leader")
+	flag.StringVar(&gossipAddr, "gossipaddr", "", "Enable gossip membership on this bind address (optional)")
+	flag.StringVar(&gossipJoin, "gossipjoin", "", "Set a comma separated list of gossip seed addresses (optional)")
+	flag.StringVar(&clusterName, "cluster", "", "Set the cluster name gossiped to other nodes (optional)")
+	flag.StringVar(&discover, "discover", "", "Discover nodes to join from file:<path>, dns:<name>:<port> or srv:<name> (optional)")
+	flag.BoolVar(&leaveOnExit, "leave", false, "Leave the cluster when exiting")
+	flag.StringVar(&bulkLoad, "bulkload", "", "Build the initial state from a JSON Lines export before starting (optional)")
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [options] <raft-data-path> \n", os.Args[0])
 		flag.PrintDefaults()
@@ -60,29 +95,63 @@ func main() {
 	config.StorageDir = raftDir
 	config.RaftBind = raftAddr
 	config.RPCBind = rpcAddr
+	config.RaftAdvertise = raftAdvertise
+	config.RPCAdvertise = rpcAdvertise
+	config.SinglePort = singlePort
+	config.LeaveOnShutdown = leaveOnExit
+	config.Bootstrap = bootstrap
+	config.BootstrapExpect = bootstrapExpect
+	config.NonVoter = nonVoter
+	config.Autopilot = autopilot
+	config.Zone = zone
+	config.ZonePlacement = zonePlacement
+	config.GossipBind = gossipAddr
+	config.ClusterName = clusterName
 
-	db, err = blehdb.NewServer(config)
-	if err != nil {
-		panic(err)
+	if joinAddr != "" {
+		config.RetryJoin = strings.Split(joinAddr, ",")
+	}
+	if gossipJoin != "" {
+		config.GossipJoin = strings.Split(gossipJoin, ",")
+	}
+	if discover != "" {
+		d, err := parseDiscoverer(discover)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -discover: %v\n", err)
+			os.Exit(1)
+		}
+		config.Discoverer = d
 	}
 
-	fmt.Println("Join:", joinAddr)
-	if joinAddr != "" {
-		fmt.Printf("Attempting to join: '%v'\n", joinAddr)
-		err := db.Join(joinAddr)
+	if bulkLoad != "" {
+		f, err := os.Open(bulkLoad)
+		if err != nil {
+			panic(err)
+		}
+		n, err := blehdb.BulkLoad(config, f)
+		f.Close()
 		if err != nil {
 			panic(err)
 		}
+		fmt.Printf("Bulk loaded %d items\n", n)
+	}
+
+	db, err = blehdb.NewServer(config)
+	if err != nil {
+		panic(err)
 	}
 
 	mux := goji.NewMux()
 	mux.HandleFunc(pat.Get("/status"), handleStatus)
+	mux.HandleFunc(pat.Get("/health"), handleHealth)
 	mux.HandleFunc(pat.Get("/data/:bucket/:key"), handleGetKey)
 	mux.HandleFunc(pat.Post("/data/:bucket/:key"), handleSetKey)
 	mux.HandleFunc(pat.Delete("/data/:bucket/:key"), handleDeleteKey)
 	mux.HandleFunc(pat.Post("/data/:bucket"), handleCreateBucket)
 	mux.HandleFunc(pat.Delete("/data/:bucket"), handleDeleteBucket)
 	mux.HandleFunc(pat.Get("/data"), handleListBuckets)
+	mux.HandleFunc(pat.Get("/export"), handleExport)
+	mux.HandleFunc(pat.Post("/import"), handleImport)
 
 	go func() {
 		err := http.ListenAndServe(httpAddr, mux)
@@ -95,4 +164,37 @@ func main() {
 	signal.Notify(terminate, os.Interrupt)
 	<-terminate
 	log.Println("exiting!")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := db.Shutdown(ctx); err != nil {
+		log.Printf("shutdown: %v", err)
+	}
+}
+
+// parseDiscoverer builds a discoverer from a -discover flag value.
+func parseDiscoverer(v string) (blehdb.Discoverer, error) {
+	parts := strings.SplitN(v, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("expected <kind>:<target>, got '%s'", v)
+	}
+
+	switch parts[0] {
+	case "file":
+		return &blehdb.FileDiscoverer{Path: parts[1]}, nil
+	case "srv":
+		return &blehdb.DNSDiscoverer{Name: parts[1], SRV: true}, nil
+	case "dns":
+		host, port, err := net.SplitHostPort(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, err
+		}
+		return &blehdb.DNSDiscoverer{Name: host, Port: p}, nil
+	}
+
+	return nil, fmt.Errorf("unknown discovery kind '%s'", parts[0])
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/joshkrueger/blehdb"
+)
+
+var index uint64
+var at string
+var out string
+var keyFile string
+
+func init() {
+	flag.Uint64Var(&index, "index", 0, "Recover up to and including this raft index")
+	flag.StringVar(&at, "time", "", "Recover up to this time (RFC3339)")
+	flag.StringVar(&out, "out", "", "Write the recovered store to this file instead of stdout")
+	flag.StringVar(&keyFile, "keyfile", "", "Decrypt the archive with keys from this file")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] <archive-dir> \n", os.Args[0])
+		flag.PrintDefaults()
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "No archive directory specified\n")
+		os.Exit(1)
+	}
+
+	target := blehdb.RecoveryTarget{Index: index}
+	if at != "" {
+		t, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid time: %v\n", err)
+			os.Exit(1)
+		}
+		target.Time = t
+	}
+
+	var keys blehdb.KeyProvider
+	if keyFile != "" {
+		keys = &blehdb.FileKeyProvider{Path: keyFile}
+	}
+
+	s, applied, err := blehdb.RecoverStoreWithKeys(flag.Arg(0), target, keys)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Recovery failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	b, err := s.Backup()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Backup failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Fprintf(os.Stderr, "Recovered state at index %d\n", applied)
+
+	if out == "" {
+		os.Stdout.Write(b)
+		return
+	}
+
+	if err := ioutil.WriteFile(out, b, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Writing output failed: %v\n", err)
+		os.Exit(1)
+	}
+}
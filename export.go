@@ -0,0 +1,177 @@
+package blehdb
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"unicode/utf8"
+)
+
+// importBatchSize is the number of items written per raft log entry during an
+// import.
+const importBatchSize = 256
+
+// ExportRecord is a single line of the JSON Lines export format. Values that
+// are not valid UTF-8 are base64 encoded, which is noted in Encoding. A bucket
+// without items is exported as a single record with Empty set, which creates
+// the bucket but no item.
+type ExportRecord struct {
+	Bucket   string `json:"bucket"`
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Encoding string `json:"encoding,omitempty"`
+	Size     int    `json:"size"`
+	Empty    bool   `json:"empty,omitempty"`
+}
+
+func newExportRecord(bucket, key, value string) *ExportRecord {
+	r := &ExportRecord{
+		Bucket: bucket,
+		Key:    key,
+		Value:  value,
+		Size:   len(value),
+	}
+
+	if !utf8.ValidString(value) {
+		r.Value = base64.StdEncoding.EncodeToString([]byte(value))
+		r.Encoding = "base64"
+	}
+
+	return r
+}
+
+func (r *ExportRecord) decodeValue() (string, error) {
+	switch r.Encoding {
+	case "":
+		return r.Value, nil
+	case "base64":
+		b, err := base64.StdEncoding.DecodeString(r.Value)
+		return string(b), err
+	default:
+		return "", fmt.Errorf("unknown value encoding '%s'", r.Encoding)
+	}
+}
+
+// Export writes the given buckets, or every bucket when none are given, to w
+// as JSON Lines. Data is read from the local store, one bucket at a time, and
+// written to w only after the store's locks are released, so a slow reader
+// does not hold up the FSM.
+func (s *Server) Export(w io.Writer, buckets ...string) error {
+	if len(buckets) == 0 {
+		buckets = s.ListBuckets()
+		sort.Strings(buckets)
+	}
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	for _, bucket := range buckets {
+		items, err := s.fsm.Store().Items(bucket)
+		if err != nil {
+			return err
+		}
+
+		if len(items) == 0 {
+			if err := enc.Encode(&ExportRecord{Bucket: bucket, Empty: true}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		keys := make([]string, 0, len(items))
+		for key := range items {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if err := enc.Encode(newExportRecord(bucket, key, items[key])); err != nil {
+				return err
+			}
+		}
+	}
+
+	return bw.Flush()
+}
+
+// Import reads JSON Lines produced by Export from r and applies them through
+// raft in batches. Buckets that do not exist yet are created. The number of
+// imported items is returned along with a token for the last batch.
+func (s *Server) Import(ctx context.Context, r io.Reader) (int, ConsistencyToken, error) {
+	dec := json.NewDecoder(r)
+	created := make(map[string]bool)
+	batch := &batchCommand{}
+	count, pending := 0, 0
+	var token ConsistencyToken
+
+	flush := func() error {
+		if len(batch.Ops) == 0 {
+			return nil
+		}
+
+		b, err := encodeMessage(BatchRequestType, batch)
+		if err != nil {
+			return err
+		}
+
+		token, err = s.apply(ctx, b)
+		if err != nil {
+			return err
+		}
+
+		count += pending
+		batch, pending = &batchCommand{}, 0
+		return nil
+	}
+
+	for {
+		var rec ExportRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, token, fmt.Errorf("reading import: %v", err)
+		}
+
+		value, err := rec.decodeValue()
+		if err != nil {
+			return count, token, err
+		}
+
+		if !created[rec.Bucket] {
+			batch.Ops = append(batch.Ops, batchOp{
+				Type:    CreateBucketRequestType,
+				command: command{Bucket: rec.Bucket},
+			})
+			created[rec.Bucket] = true
+		}
+
+		if rec.Empty {
+			continue
+		}
+
+		batch.Ops = append(batch.Ops, batchOp{
+			Type:    SetItemRequestType,
+			command: command{Bucket: rec.Bucket, Key: rec.Key, Value: value},
+		})
+
+		pending++
+
+		if len(batch.Ops) >= importBatchSize {
+			if err := flush(); err != nil {
+				return count, token, err
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return count, token, err
+	}
+
+	return count, token, nil
+}
@@ -0,0 +1,67 @@
+package blehdb
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestExportRecord(t *testing.T) {
+	r := newExportRecord("foo", "bar", "baz")
+	if r.Encoding != "" || r.Value != "baz" {
+		t.Errorf("text values should be exported as-is, got: %+v", r)
+	}
+
+	binary := string([]byte{0xff, 0x00, 0xfe})
+	r = newExportRecord("foo", "bar", binary)
+	if r.Encoding != "base64" {
+		t.Errorf("binary values should be base64 encoded, got: %+v", r)
+	}
+
+	v, err := r.decodeValue()
+	if err != nil {
+		t.Fatalf("unexpected error decoding value: %v", err)
+	}
+
+	if v != binary {
+		t.Errorf("decoded value does not match the original")
+	}
+
+	r.Encoding = "rot13"
+	if _, err := r.decodeValue(); err == nil {
+		t.Error("unknown encodings should return an error")
+	}
+}
+
+func TestExportRoundTrip(t *testing.T) {
+	s := &Server{fsm: setupFSM(t)}
+	s.fsm.Store().CreateBucket("foo")
+	s.fsm.Store().SetItem("foo", "b", "2")
+	s.fsm.Store().SetItem("foo", "a", "1")
+	s.fsm.Store().CreateBucket("empty")
+
+	var buf bytes.Buffer
+	if err := s.Export(&buf); err != nil {
+		t.Fatalf("error exporting: %v", err)
+	}
+
+	expected := `{"bucket":"empty","key":"","value":"","size":0,"empty":true}
+{"bucket":"foo","key":"a","value":"1","size":1}
+{"bucket":"foo","key":"b","value":"2","size":1}
+`
+	if buf.String() != expected {
+		t.Errorf("unexpected export:\n%s", buf.String())
+	}
+
+	loaded, count, err := loadRecords(&buf)
+	if err != nil {
+		t.Fatalf("error loading export: %v", err)
+	}
+
+	if count != 2 {
+		t.Errorf("expected 2 items, got: %v", count)
+	}
+
+	if !loaded.BucketExists("empty") {
+		t.Error("empty buckets should survive an export round trip")
+	}
+}
@@ -0,0 +1,245 @@
+package blehdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// forwardRetryInterval is how long to wait before retrying a forwarded
+	// command that could not reach a leader.
+	forwardRetryInterval = 250 * time.Millisecond
+
+	// rpcDialTimeout bounds dialing a peer's RPC server when the caller's
+	// context has no earlier deadline.
+	rpcDialTimeout = 5 * time.Second
+)
+
+// ErrNoLeader is returned when a command cannot be applied because the
+// cluster has no known leader.
+var ErrNoLeader = errors.New("no known leader")
+
+// apply applies an encoded message through raft. On followers the message is
+// forwarded to the current leader over RPC.
+func (s *Server) apply(ctx context.Context, msg []byte) (ConsistencyToken, error) {
+	var token ConsistencyToken
+	err := s.retryLeader(ctx, func() error {
+		var err error
+		if s.raft.State() == raft.Leader {
+			token, err = s.applyRaft(ctx, msg)
+			return err
+		}
+
+		var resp ApplyResponse
+		err = s.forwardToLeader(ctx, "Management.Apply", &ApplyRequest{Message: msg}, &resp)
+		token = resp.Token
+		return err
+	})
+
+	return token, err
+}
+
+// forwardable reports whether msg is a data mutation that a follower may
+// forward to the leader through Management.Apply.
+func forwardable(msg []byte) bool {
+	if len(msg) == 0 {
+		return false
+	}
+
+	switch messageType(msg[0]) {
+	case CreateBucketRequestType, DeleteBucketRequestType, SetItemRequestType, DeleteItemRequestType, BatchRequestType:
+		return true
+	}
+
+	return false
+}
+
+// retryLeader calls fn until it succeeds or fails with an error that is not
+// retryable. Attempts that fail before reaching the leader, such as during an
+// election, are retried until ctx is done.
+func (s *Server) retryLeader(ctx context.Context, fn func() error) error {
+	for {
+		if s.isShutdown() {
+			return ErrShutdown
+		}
+
+		err := fn()
+		if err == nil || !isRetryable(err) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%v (last error: %v)", ctx.Err(), err)
+		case <-s.shutdownCh:
+			return ErrShutdown
+		case <-time.After(forwardRetryInterval):
+		}
+	}
+}
+
+// forwardToLeader calls an RPC method on the current leader.
+func (s *Server) forwardToLeader(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	addr, ok := s.leaderRPCAddr()
+	if !ok {
+		return ErrNoLeader
+	}
+
+	return remoteError(s.callRPC(ctx, addr, method, args, reply))
+}
+
+// remoteErrors are the sentinel errors a leader may return to a forwarded
+// call, which callers compare against.
+var remoteErrors = []error{ErrAutopilotDisabled, ErrNoTransferTarget}
+
+// remoteError restores the identity of a sentinel error returned by a remote
+// RPC handler, which net/rpc only passes on as a string.
+func remoteError(err error) error {
+	if _, ok := err.(rpc.ServerError); !ok {
+		return err
+	}
+
+	for _, sentinel := range remoteErrors {
+		if err.Error() == sentinel.Error() {
+			return sentinel
+		}
+	}
+
+	return err
+}
+
+// isRetryable reports whether err guarantees the message was not applied, so
+// that it is safe to try again. Errors such as raft.ErrLeadershipLost leave
+// the outcome unknown and are returned to the caller instead.
+func isRetryable(err error) bool {
+	switch err {
+	case ErrNoLeader, raft.ErrNotLeader:
+		return true
+	}
+
+	// Errors returned by a remote RPC handler lose their identity.
+	if _, ok := err.(rpc.ServerError); ok {
+		return err.Error() == raft.ErrNotLeader.Error()
+	}
+
+	// Failing to reach the leader means it never received the message.
+	if _, ok := err.(*net.OpError); ok {
+		return true
+	}
+
+	return false
+}
+
+// callRPC calls a method on the RPC server at addr, giving up when ctx is
+// done.
+func (s *Server) callRPC(ctx context.Context, addr, method string, args interface{}, reply interface{}) error {
+	timeout := rpcDialTimeout
+	if deadline, ok := ctx.Deadline(); ok && deadline.Sub(time.Now()) < timeout {
+		timeout = deadline.Sub(time.Now())
+	}
+
+	conn, err := s.dialRPC(addr, timeout)
+	if err != nil {
+		return err
+	}
+
+	client := rpc.NewClient(conn)
+	defer client.Close()
+
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// monitorLeadership reacts to the local node gaining or losing leadership.
+func (s *Server) monitorLeadership() {
+	leaderCh := s.raft.LeaderCh()
+
+	// stopCh is closed to stop the leader's loops when leadership is lost.
+	var stopCh chan struct{}
+
+	for {
+		select {
+		case isLeader := <-leaderCh:
+			if isLeader {
+				s.publish(Event{Type: EventBecameLeader, Leader: s.config.RaftAdvertise})
+
+				// Registering waits on raft, and the loop must keep receiving
+				// so that losing leadership meanwhile is not missed.
+				go s.registerSelf()
+
+				if stopCh == nil {
+					stopCh = make(chan struct{})
+					if s.config.Autopilot {
+						go s.runAutopilot(stopCh)
+					}
+					if s.config.ZonePlacement {
+						go s.runPlacement(stopCh)
+					}
+					if s.gossip != nil {
+						go s.runReconcile(stopCh)
+					}
+				}
+			} else {
+				s.publish(Event{Type: EventLostLeadership, Leader: string(s.raft.Leader())})
+
+				if stopCh != nil {
+					close(stopCh)
+					stopCh = nil
+				}
+			}
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+// registerSelf records the leader's own RPC address in the member registry so
+// that followers can forward commands to it.
+func (s *Server) registerSelf() {
+	ctx, cancel := context.WithTimeout(context.Background(), raftApplyTimeout)
+	defer cancel()
+
+	// A new leader may still be replaying the log, in which case the registry
+	// does not hold its entry yet.
+	if err := s.WaitForIndex(ctx, s.fsmIndex(s.raft.LastIndex())); err != nil {
+		s.logger.Printf("error waiting for the log to be applied before registering: %v", err)
+		return
+	}
+
+	if m, ok := s.fsm.Member(s.id); ok && m.RaftAddr == s.config.RaftAdvertise && m.RPCAddr == s.config.RPCAdvertise && m.Zone == s.config.Zone {
+		return
+	}
+
+	err := s.registerMember(ctx, &member{
+		ID:       s.id,
+		RaftAddr: s.config.RaftAdvertise,
+		RPCAddr:  s.config.RPCAdvertise,
+		Zone:     s.config.Zone,
+	})
+	if err != nil {
+		s.logger.Printf("error registering leader in member registry: %v", err)
+	}
+}
+
+// registerMember records m in the member registry. It must be called on the
+// leader, as membership changes are not forwarded.
+func (s *Server) registerMember(ctx context.Context, m *member) error {
+	b, err := encodeMessage(RegisterMemberRequestType, m)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.applyRaft(ctx, b)
+	return err
+}
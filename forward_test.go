@@ -0,0 +1,106 @@
+package blehdb
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestIsRetryable(t *testing.T) {
+	cases := []struct {
+		err       error
+		retryable bool
+	}{
+		{ErrNoLeader, true},
+		{raft.ErrNotLeader, true},
+		{rpc.ServerError(raft.ErrNotLeader.Error()), true},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{raft.ErrLeadershipLost, false},
+		{rpc.ServerError("bucket 'foo' does not exist"), false},
+		{errors.New("something else"), false},
+	}
+
+	for _, c := range cases {
+		if isRetryable(c.err) != c.retryable {
+			t.Errorf("isRetryable(%v) should be %v", c.err, c.retryable)
+		}
+	}
+}
+
+func TestForwardable(t *testing.T) {
+	set, _ := encodeMessage(SetItemRequestType, &command{Bucket: "foo"})
+	if !forwardable(set) {
+		t.Error("data mutations should be forwardable")
+	}
+
+	register, _ := encodeMessage(RegisterMemberRequestType, &member{ID: "foo"})
+	if forwardable(register) {
+		t.Error("membership changes should not be forwardable")
+	}
+
+	if forwardable(nil) {
+		t.Error("an empty message should not be forwardable")
+	}
+}
+
+func TestForwardFromFollower(t *testing.T) {
+	servers := testCluster(t, 2, nil)
+	leader, follower := servers[0], servers[1]
+	ctx := testContext(t)
+
+	if _, err := follower.CreateBucket(ctx, "foo"); err != nil {
+		t.Fatalf("error creating bucket from follower: %v", err)
+	}
+
+	token, err := follower.Set(ctx, "foo", "bar", "baz")
+	if err != nil {
+		t.Fatalf("error setting item from follower: %v", err)
+	}
+
+	if token == 0 {
+		t.Error("a forwarded mutation should return a consistency token")
+	}
+
+	val, _, err := leader.Get(ctx, "foo", "bar", &ReadOptions{Consistency: ConsistencyStale})
+	if err != nil || val != "baz" {
+		t.Errorf("expected the leader to have applied the forwarded write, got: '%v', %v", val, err)
+	}
+
+	val, _, err = follower.Get(ctx, "foo", "bar", &ReadOptions{Consistency: ConsistencyStale, Token: token})
+	if err != nil || val != "baz" {
+		t.Errorf("expected the follower to observe its own write, got: '%v', %v", val, err)
+	}
+
+	// Membership changes cannot be smuggled in through Management.Apply.
+	msg, _ := encodeMessage(RegisterMemberRequestType, &member{ID: "rogue", RaftAddr: "127.0.0.1:1"})
+	var resp ApplyResponse
+	if err := follower.callRPC(ctx, leader.config.RPCAdvertise, "Management.Apply", &ApplyRequest{Message: msg}, &resp); err == nil {
+		t.Error("forwarding a membership change should fail")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := leader.fsm.Member("rogue"); ok {
+		t.Error("a rejected message should not be applied")
+	}
+}
+
+func TestRemoteError(t *testing.T) {
+	if err := remoteError(rpc.ServerError(ErrAutopilotDisabled.Error())); err != ErrAutopilotDisabled {
+		t.Errorf("expected ErrAutopilotDisabled, got: %v", err)
+	}
+
+	other := rpc.ServerError("something else")
+	if err := remoteError(other); err != other {
+		t.Errorf("expected other remote errors to be kept, got: %v", err)
+	}
+
+	// Only errors returned by a remote handler are mapped.
+	local := errors.New(ErrAutopilotDisabled.Error())
+	if err := remoteError(local); err != local {
+		t.Errorf("expected a local error to be kept, got: %v", err)
+	}
+}
@@ -3,9 +3,12 @@ package blehdb
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"sync"
 
 	"github.com/hashicorp/raft"
 	"github.com/joshkrueger/blehdb/store"
@@ -18,9 +21,13 @@ const (
 	DeleteBucketRequestType
 	SetItemRequestType
 	DeleteItemRequestType
+	BatchRequestType
+	EncryptedRequestType
+	RegisterMemberRequestType
+	DeregisterMemberRequestType
 )
 
-func encodeMessage(t messageType, c *command) ([]byte, error) {
+func encodeMessage(t messageType, c interface{}) ([]byte, error) {
 	var buf bytes.Buffer
 	buf.WriteByte(uint8(t))
 
@@ -38,15 +45,67 @@ type command struct {
 	Value  string
 }
 
+// batchCommand applies several commands within a single raft log entry.
+type batchCommand struct {
+	Ops []batchOp
+}
+
+type batchOp struct {
+	Type messageType
+	command
+}
+
+// member describes a cluster member as recorded in the replicated member
+// registry, keyed by server ID. Entries written before server IDs existed
+// have none and are keyed by raft address, which is also the ID raft gives
+// such members.
+type member struct {
+	ID       string
+	RaftAddr string
+	RPCAddr  string
+	NonVoter bool
+
+	// Zone is the failure domain the member runs in, if known.
+	Zone string
+
+	// Demoted marks a voter that zone placement turned into a non-voter. Only
+	// demoted members are promoted back by placement.
+	Demoted bool
+}
+
+// fsmState is the snapshot format. Older snapshots contain only the store
+// backup and are still accepted by Restore.
+type fsmState struct {
+	Index   uint64
+	Store   json.RawMessage
+	Members map[string]*member
+}
+
 type blehFSM struct {
-	logger *log.Logger
-	store  *store.BlehStore
+	logger   *log.Logger
+	store    *store.BlehStore
+	archiver *logArchiver
+	keyring  *keyring
+
+	// notify, when set, receives membership and snapshot events.
+	notify func(Event)
+
+	members     map[string]*member
+	membersLock sync.RWMutex
+
+	// index is the raft index of the last log entry applied to the store.
+	// Channels in waiters are closed once index reaches their value.
+	index     uint64
+	waiters   map[chan struct{}]uint64
+	indexLock sync.Mutex
 }
 
 func NewFSM() (*blehFSM, error) {
 	fsm := &blehFSM{
-		logger: log.New(os.Stdout, "[FSM] ", log.LstdFlags),
-		store:  store.New(),
+		logger:  log.New(os.Stdout, "[FSM] ", log.LstdFlags),
+		store:   store.New(),
+		members: make(map[string]*member),
+		waiters: make(map[chan struct{}]uint64),
 	}
 
 	return fsm, nil
@@ -54,9 +113,31 @@ func NewFSM() (*blehFSM, error) {
 
 func (b *blehFSM) Apply(log *raft.Log) interface{} {
 	buf := log.Data
-
 	msgType := messageType(buf[0])
 
+	// An entry that cannot be decrypted cannot be skipped either, as every
+	// later entry would then apply to a store that differs from the rest of
+	// the cluster. Stop before the entry is archived or marked applied.
+	if msgType == EncryptedRequestType {
+		if b.keyring == nil {
+			b.logger.Panicf("log entry %d is encrypted but no key provider is configured", log.Index)
+		}
+
+		plain, err := b.keyring.decrypt(buf[1:])
+		if err != nil {
+			b.logger.Panicf("error decrypting log entry %d: %v", log.Index, err)
+		}
+
+		buf = plain
+		msgType = messageType(buf[0])
+	}
+
+	defer b.setIndex(log.Index)
+
+	if b.archiver != nil {
+		defer b.archiver.archiveLog(log)
+	}
+
 	switch msgType {
 	case CreateBucketRequestType:
 		return b.applyCreateBucket(buf[1:], log.Index)
@@ -66,6 +147,12 @@ func (b *blehFSM) Apply(log *raft.Log) interface{} {
 		return b.applySetItem(buf[1:], log.Index)
 	case DeleteItemRequestType:
 		return b.applyDeleteItem(buf[1:], log.Index)
+	case BatchRequestType:
+		return b.applyBatch(buf[1:], log.Index)
+	case RegisterMemberRequestType:
+		return b.applyRegisterMember(buf[1:], log.Index)
+	case DeregisterMemberRequestType:
+		return b.applyDeregisterMember(buf[1:], log.Index)
 	default:
 		b.logger.Printf("WARNING: ignoring unknown message type (%d)", msgType)
 		return nil
@@ -76,6 +163,107 @@ func (b *blehFSM) Store() *store.BlehStore {
 	return b.store
 }
 
+// AppliedIndex returns the raft index of the last command or configuration
+// entry applied. Unlike raft's own applied index, it is only advanced once the
+// entry is visible to reads. Entries that never reach the FSM, such as the
+// noop a new leader appends, leave it unchanged.
+func (b *blehFSM) AppliedIndex() uint64 {
+	b.indexLock.Lock()
+	defer b.indexLock.Unlock()
+
+	return b.index
+}
+
+// IndexCh returns a channel that is closed once index has been applied. The
+// returned cancel func must be called if the caller stops waiting early.
+func (b *blehFSM) IndexCh(index uint64) (<-chan struct{}, func()) {
+	b.indexLock.Lock()
+	defer b.indexLock.Unlock()
+
+	ch := make(chan struct{})
+	if b.index >= index {
+		close(ch)
+		return ch, func() {}
+	}
+
+	b.waiters[ch] = index
+	return ch, func() {
+		b.indexLock.Lock()
+		defer b.indexLock.Unlock()
+		delete(b.waiters, ch)
+	}
+}
+
+// StoreConfiguration is called by raft for every committed configuration
+// entry. The configuration itself is read from raft when needed; recording
+// the index keeps reads that wait on it from stalling until the next command.
+func (b *blehFSM) StoreConfiguration(index uint64, configuration raft.Configuration) {
+	b.setIndex(index)
+}
+
+// setIndex advances the applied index. It never moves backwards, as waiters
+// may already have been released at the higher index.
+func (b *blehFSM) setIndex(index uint64) {
+	b.indexLock.Lock()
+	defer b.indexLock.Unlock()
+
+	if index <= b.index {
+		return
+	}
+
+	b.index = index
+	for ch, waitIndex := range b.waiters {
+		if waitIndex <= index {
+			close(ch)
+			delete(b.waiters, ch)
+		}
+	}
+}
+
+// Member returns the registry entry for the member with the given server ID.
+func (b *blehFSM) Member(id string) (*member, bool) {
+	b.membersLock.RLock()
+	defer b.membersLock.RUnlock()
+
+	m, ok := b.members[id]
+	if !ok {
+		return nil, false
+	}
+
+	c := *m
+	return &c, true
+}
+
+// MemberByAddr returns the registry entry for the member with the given raft
+// address.
+func (b *blehFSM) MemberByAddr(raftAddr string) (*member, bool) {
+	b.membersLock.RLock()
+	defer b.membersLock.RUnlock()
+
+	for _, m := range b.members {
+		if m.RaftAddr == raftAddr {
+			c := *m
+			return &c, true
+		}
+	}
+
+	return nil, false
+}
+
+// Members returns every entry in the member registry.
+func (b *blehFSM) Members() []*member {
+	b.membersLock.RLock()
+	defer b.membersLock.RUnlock()
+
+	var members []*member
+	for _, m := range b.members {
+		c := *m
+		members = append(members, &c)
+	}
+
+	return members
+}
+
 func (b *blehFSM) applySetItem(buf []byte, index uint64) interface{} {
 	var c command
 	err := decodeMessage(buf, &c)
@@ -132,31 +320,212 @@ func (b *blehFSM) applyDeleteBucket(buf []byte, index uint64) interface{} {
 	return err
 }
 
+func (b *blehFSM) applyBatch(buf []byte, index uint64) interface{} {
+	var c batchCommand
+	err := decodeMessage(buf, &c)
+	if err != nil {
+		return err
+	}
+	b.logger.Printf("(Index:%v) Applying batch of %d operations", index, len(c.Ops))
+
+	// Every operation is attempted so that all members end up in the same
+	// state; the first failure is reported back to the caller.
+	var firstErr error
+	for _, op := range c.Ops {
+		var err error
+		switch op.Type {
+		case CreateBucketRequestType:
+			// Creating a bucket in a batch is idempotent so that batches
+			// built from possibly stale reads still apply cleanly.
+			if !b.store.BucketExists(op.Bucket) {
+				err = b.store.CreateBucket(op.Bucket)
+			}
+		case DeleteBucketRequestType:
+			err = b.store.DeleteBucket(op.Bucket)
+		case SetItemRequestType:
+			err = b.store.SetItem(op.Bucket, op.Key, op.Value)
+		case DeleteItemRequestType:
+			err = b.store.DeleteItem(op.Bucket, op.Key)
+		default:
+			err = fmt.Errorf("unsupported batch operation (%d)", op.Type)
+		}
+		if err != nil {
+			b.logger.Printf("error during batch: %v", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+func (b *blehFSM) applyRegisterMember(buf []byte, index uint64) interface{} {
+	var m member
+	err := decodeMessage(buf, &m)
+	if err != nil {
+		return err
+	}
+	if m.ID == "" {
+		m.ID = m.RaftAddr
+	}
+	b.logger.Printf("(Index:%v) Registering Member: '%s' at '%s' with RPC address '%s'", index, m.ID, m.RaftAddr, m.RPCAddr)
+
+	b.membersLock.Lock()
+	old, existed := b.members[m.ID]
+	b.members[m.ID] = &m
+	b.membersLock.Unlock()
+
+	switch {
+	case !existed:
+		b.publish(Event{Type: EventPeerAdded, Peer: m.ID, Address: m.RaftAddr, NonVoter: m.NonVoter, Index: index})
+	case !old.NonVoter && m.NonVoter:
+		b.publish(Event{Type: EventPeerDemoted, Peer: m.ID, Address: m.RaftAddr, NonVoter: true, Index: index})
+	case old.NonVoter && !m.NonVoter:
+		b.publish(Event{Type: EventPeerPromoted, Peer: m.ID, Address: m.RaftAddr, Index: index})
+	}
+
+	return nil
+}
+
+func (b *blehFSM) applyDeregisterMember(buf []byte, index uint64) interface{} {
+	var m member
+	err := decodeMessage(buf, &m)
+	if err != nil {
+		return err
+	}
+	if m.ID == "" {
+		m.ID = m.RaftAddr
+	}
+	b.logger.Printf("(Index:%v) Deregistering Member: '%s'", index, m.ID)
+
+	b.membersLock.Lock()
+	old, existed := b.members[m.ID]
+	delete(b.members, m.ID)
+	b.membersLock.Unlock()
+
+	if existed {
+		b.publish(Event{Type: EventPeerRemoved, Peer: m.ID, Address: old.RaftAddr, NonVoter: old.NonVoter, Index: index})
+	}
+
+	return nil
+}
+
+func (b *blehFSM) publish(e Event) {
+	if b.notify != nil {
+		b.notify(e)
+	}
+}
+
 func (b *blehFSM) Snapshot() (raft.FSMSnapshot, error) {
 	b.logger.Println("Calling Snapshot")
-	buf, err := b.store.Backup()
+
+	// Pick up any key rotation so the snapshot, and every log entry written
+	// after it, is encrypted with the current active key.
+	if b.keyring != nil {
+		if err := b.keyring.reload(); err != nil {
+			b.logger.Printf("error reloading encryption keys, using cached keys: %v", err)
+		}
+	}
+
+	storeBuf, err := b.store.Backup()
+	if err != nil {
+		return nil, err
+	}
+
+	index := b.AppliedIndex()
+
+	b.membersLock.RLock()
+	buf, err := json.Marshal(&fsmState{
+		Index:   index,
+		Store:   storeBuf,
+		Members: b.members,
+	})
+	b.membersLock.RUnlock()
+
 	return &fsmSnapshot{
-		snap: buf,
+		snap:     buf,
+		index:    index,
+		archiver: b.archiver,
+		keyring:  b.keyring,
+		notify:   b.publish,
 	}, err
 }
 
 func (b *blehFSM) Restore(old io.ReadCloser) error {
-	new, err := store.Restore(old)
+	raw, err := ioutil.ReadAll(old)
+	if err != nil {
+		return err
+	}
+
+	buf, err := b.keyring.decryptSnapshot(raw)
+	if err != nil {
+		return err
+	}
+
+	var state fsmState
+	if err := json.Unmarshal(buf, &state); err != nil {
+		return err
+	}
+
+	// Snapshots written before the member registry existed hold only the
+	// store backup.
+	if state.Store == nil {
+		state.Store = buf
+	}
+	if state.Members == nil {
+		state.Members = make(map[string]*member)
+	}
+	for key, m := range state.Members {
+		if m.ID == "" {
+			m.ID = key
+		}
+	}
+
+	new, err := store.Restore(ioutil.NopCloser(bytes.NewReader(state.Store)))
 	if err != nil {
 		return err
 	}
 	b.store = new
+
+	b.membersLock.Lock()
+	b.members = state.Members
+	b.membersLock.Unlock()
+
+	b.setIndex(state.Index)
+
+	// A snapshot installed from the leader replaces entries this member never
+	// applied, so it is archived to keep the archive free of gaps. Snapshots
+	// restored at start were archived when they were taken.
+	if b.archiver != nil {
+		b.archiver.archiveSnapshot(state.Index, raw)
+	}
+
+	b.publish(Event{Type: EventSnapshotRestored, Index: state.Index})
+
 	return nil
 }
 
 type fsmSnapshot struct {
-	snap []byte
+	snap     []byte
+	index    uint64
+	archiver *logArchiver
+	keyring  *keyring
+	notify   func(Event)
 }
 
 func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	snap := s.snap
+
 	err := func() error {
+		if s.keyring != nil {
+			var err error
+			snap, err = s.keyring.encryptSnapshot(s.snap)
+			if err != nil {
+				return err
+			}
+		}
 
-		if _, err := sink.Write(s.snap); err != nil {
+		if _, err := sink.Write(snap); err != nil {
 			return err
 		}
 
@@ -172,6 +541,14 @@ func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
 		return err
 	}
 
+	if s.archiver != nil {
+		s.archiver.archiveSnapshot(s.index, snap)
+	}
+
+	if s.notify != nil {
+		s.notify(Event{Type: EventSnapshotTaken, Index: s.index})
+	}
+
 	return nil
 }
 
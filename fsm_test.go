@@ -1,7 +1,9 @@
 package blehdb
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"testing"
 
@@ -215,6 +217,186 @@ func TestApplyDeleteBucket(t *testing.T) {
 	}
 }
 
+func TestApplyBatch(t *testing.T) {
+	fsm := setupFSM(t)
+
+	batch := &batchCommand{
+		Ops: []batchOp{
+			{Type: CreateBucketRequestType, command: command{Bucket: "foo"}},
+			{Type: SetItemRequestType, command: command{Bucket: "foo", Key: "bar", Value: "baz"}},
+			{Type: SetItemRequestType, command: command{Bucket: "dne", Key: "bar", Value: "baz"}},
+			{Type: SetItemRequestType, command: command{Bucket: "foo", Key: "baz", Value: "qux"}},
+		},
+	}
+
+	msg, err := encodeMessage(BatchRequestType, batch)
+	if err != nil {
+		t.Fatalf("error encoding message: %v", err)
+	}
+
+	resp := fsm.Apply(mockLog(msg))
+	if resp == nil {
+		t.Errorf("setting an item on a non-existent bucket should have raised an error")
+	}
+
+	for k, v := range map[string]string{"bar": "baz", "baz": "qux"} {
+		val, err := fsm.Store().GetItem("foo", k)
+		if err != nil {
+			t.Fatalf("error fetching item: %v", err)
+		}
+		if val != v {
+			t.Errorf("value should be: '%v', got: '%v'", v, val)
+		}
+	}
+}
+
+func TestApplyRegisterMember(t *testing.T) {
+	fsm := setupFSM(t)
+
+	m := &member{
+		ID:       "node1",
+		RaftAddr: "127.0.0.1:11000",
+		RPCAddr:  "127.0.0.1:12000",
+	}
+
+	msg, err := encodeMessage(RegisterMemberRequestType, m)
+	if err != nil {
+		t.Fatalf("error encoding message: %v", err)
+	}
+
+	if resp := fsm.Apply(mockLog(msg)); resp != nil {
+		t.Fatalf("error applying raft log: %v", resp)
+	}
+
+	got, ok := fsm.Member(m.ID)
+	if !ok || *got != *m {
+		t.Fatalf("expected member %+v to be registered, got: %+v", m, got)
+	}
+
+	if got, ok := fsm.MemberByAddr(m.RaftAddr); !ok || got.ID != m.ID {
+		t.Errorf("expected member to be found by its raft address, got: %+v", got)
+	}
+
+	msg, err = encodeMessage(DeregisterMemberRequestType, &member{ID: m.ID})
+	if err != nil {
+		t.Fatalf("error encoding message: %v", err)
+	}
+
+	if resp := fsm.Apply(mockLog(msg)); resp != nil {
+		t.Fatalf("error applying raft log: %v", resp)
+	}
+
+	if _, ok := fsm.Member(m.ID); ok {
+		t.Error("member should have been deregistered")
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	fsm := setupFSM(t)
+	fsm.Store().CreateBucket("foo")
+	fsm.Store().SetItem("foo", "bar", "baz")
+	fsm.members["127.0.0.1:11000"] = &member{RaftAddr: "127.0.0.1:11000", RPCAddr: "127.0.0.1:12000"}
+
+	snap, err := fsm.Snapshot()
+	if err != nil {
+		t.Fatalf("error taking snapshot: %v", err)
+	}
+
+	restored := setupFSM(t)
+	err = restored.Restore(ioutil.NopCloser(bytes.NewReader(snap.(*fsmSnapshot).snap)))
+	if err != nil {
+		t.Fatalf("error restoring snapshot: %v", err)
+	}
+
+	val, _ := restored.Store().GetItem("foo", "bar")
+	if val != "baz" {
+		t.Errorf("value should be: 'baz', got: '%v'", val)
+	}
+
+	if _, ok := restored.Member("127.0.0.1:11000"); !ok {
+		t.Error("member registry should have been restored")
+	}
+}
+
+func TestRestoreLegacySnapshot(t *testing.T) {
+	fsm := setupFSM(t)
+	fsm.Store().CreateBucket("foo")
+
+	buf, err := fsm.Store().Backup()
+	if err != nil {
+		t.Fatalf("error backing up store: %v", err)
+	}
+
+	restored := setupFSM(t)
+	if err := restored.Restore(ioutil.NopCloser(bytes.NewReader(buf))); err != nil {
+		t.Fatalf("error restoring snapshot: %v", err)
+	}
+
+	if !restored.Store().BucketExists("foo") {
+		t.Error("bucket 'foo' should exist after restoring a store-only snapshot")
+	}
+}
+
+func TestIndexCh(t *testing.T) {
+	fsm := setupFSM(t)
+
+	ch, cancel := fsm.IndexCh(2)
+	defer cancel()
+
+	msg, err := encodeMessage(CreateBucketRequestType, &command{Bucket: "foo"})
+	if err != nil {
+		t.Fatalf("error encoding message: %v", err)
+	}
+
+	fsm.Apply(mockLog(msg))
+	select {
+	case <-ch:
+		t.Fatal("channel should not be closed before index 2 is applied")
+	default:
+	}
+
+	l := mockLog(msg)
+	l.Index = 2
+	fsm.Apply(l)
+	select {
+	case <-ch:
+	default:
+		t.Fatal("channel should be closed once index 2 is applied")
+	}
+
+	if fsm.AppliedIndex() != 2 {
+		t.Errorf("applied index should be 2, got: %v", fsm.AppliedIndex())
+	}
+
+	ch, cancel = fsm.IndexCh(1)
+	defer cancel()
+	select {
+	case <-ch:
+	default:
+		t.Fatal("channel for an already applied index should be closed")
+	}
+}
+
+func TestSetIndex(t *testing.T) {
+	fsm := setupFSM(t)
+
+	fsm.setIndex(5)
+	fsm.setIndex(3)
+	if fsm.AppliedIndex() != 5 {
+		t.Errorf("the applied index should never move backwards, got: %v", fsm.AppliedIndex())
+	}
+
+	ch, cancel := fsm.IndexCh(6)
+	defer cancel()
+
+	fsm.StoreConfiguration(6, raft.Configuration{})
+	select {
+	case <-ch:
+	default:
+		t.Fatal("configuration entries should advance the applied index")
+	}
+}
+
 func TestApplyUnknown(t *testing.T) {
 	buf := []byte("badcommand")
 
@@ -0,0 +1,373 @@
+package blehdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// gossipLeaveTimeout bounds how long a leaving member waits for its
+	// departure to be gossiped.
+	gossipLeaveTimeout = 5 * time.Second
+
+	// reconcileInterval is how often the leader reconciles raft membership
+	// with gossip when no gossip event prompts it sooner.
+	reconcileInterval = 30 * time.Second
+)
+
+// nodeMeta is the metadata each member gossips about itself.
+type nodeMeta struct {
+	Cluster  string
+	RaftAddr string
+	RPCAddr  string
+	Zone     string
+	Version  string
+	NonVoter bool
+}
+
+// gossipMember is the local view of a member as reported by gossip.
+type gossipMember struct {
+	Name  string
+	Meta  nodeMeta
+	Alive bool
+
+	// Left is set once the member has left gossip gracefully rather than
+	// failed.
+	Left bool
+
+	// Since is when the member was last seen joining or failing.
+	Since time.Time
+}
+
+// gossip runs a SWIM-style membership and failure detection layer alongside
+// the RPC server. It only reports what it sees; the leader decides what that
+// means for raft membership.
+type gossip struct {
+	server *Server
+	list   *memberlist.Memberlist
+
+	lock    sync.RWMutex
+	members map[string]*gossipMember
+
+	// changeCh is signalled whenever a member joins, fails or updates its
+	// metadata.
+	changeCh chan struct{}
+}
+
+func (s *Server) setupGossip() error {
+	host, port, err := net.SplitHostPort(s.config.GossipBind)
+	if err != nil {
+		return fmt.Errorf("invalid GossipBind: %v", err)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return fmt.Errorf("invalid GossipBind port: %v", err)
+	}
+
+	g := &gossip{
+		server:   s,
+		members:  make(map[string]*gossipMember),
+		changeCh: make(chan struct{}, 1),
+	}
+
+	conf := memberlist.DefaultLANConfig()
+	conf.Name = s.id
+	conf.BindAddr = host
+	conf.BindPort = p
+	conf.Delegate = g
+	conf.Events = g
+	conf.LogOutput = os.Stdout
+
+	g.list, err = memberlist.Create(conf)
+	if err != nil {
+		return err
+	}
+	s.gossip = g
+
+	if len(s.config.GossipJoin) > 0 {
+		go s.joinGossip(s.config.GossipJoin)
+	}
+
+	return nil
+}
+
+// joinGossip joins the gossip pool through any one of the seeds, retrying with
+// backoff until one answers.
+func (s *Server) joinGossip(seeds []string) {
+	wait := retryJoinMinWait
+	for {
+		n, err := s.gossip.list.Join(seeds)
+		if n > 0 {
+			s.logger.Printf("Joined the gossip pool through %d seeds", n)
+			return
+		}
+		s.logger.Printf("Unable to join any gossip seed, retrying in %v: %v", wait, err)
+
+		select {
+		case <-time.After(wait):
+		case <-s.shutdownCh:
+			return
+		}
+
+		wait *= 2
+		if wait > retryJoinMaxWait {
+			wait = retryJoinMaxWait
+		}
+	}
+}
+
+// leave announces the local member's departure and stops gossiping.
+func (g *gossip) leave(announce bool) {
+	if announce {
+		if err := g.list.Leave(gossipLeaveTimeout); err != nil {
+			g.server.logger.Printf("error leaving the gossip pool: %v", err)
+		}
+	}
+
+	if err := g.list.Shutdown(); err != nil {
+		g.server.logger.Printf("error shutting down gossip: %v", err)
+	}
+}
+
+// updateMeta gossips the local member's metadata again, for example after its
+// role has changed.
+func (g *gossip) updateMeta() {
+	if err := g.list.UpdateNode(gossipLeaveTimeout); err != nil {
+		g.server.logger.Printf("error updating gossip metadata: %v", err)
+	}
+}
+
+// member returns the gossip view of the member with the given name.
+func (g *gossip) member(name string) (*gossipMember, bool) {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	m, ok := g.members[name]
+	if !ok {
+		return nil, false
+	}
+
+	c := *m
+	return &c, true
+}
+
+// snapshot returns every member gossip has seen, sorted by name.
+func (g *gossip) snapshot() []*gossipMember {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	var members []*gossipMember
+	for _, m := range g.members {
+		c := *m
+		members = append(members, &c)
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Name < members[j].Name
+	})
+
+	return members
+}
+
+func (g *gossip) update(n *memberlist.Node, alive bool) {
+	// Metadata that cannot be decoded leaves what was known before in place.
+	var meta *nodeMeta
+	if n.Meta != nil {
+		meta = &nodeMeta{}
+		if err := json.Unmarshal(n.Meta, meta); err != nil {
+			g.server.logger.Printf("error decoding gossip metadata of %s: %v", n.Name, err)
+			meta = nil
+		}
+	}
+
+	g.lock.Lock()
+	m, ok := g.members[n.Name]
+	if !ok {
+		m = &gossipMember{Name: n.Name}
+		g.members[n.Name] = m
+	}
+	if !ok || m.Alive != alive {
+		m.Since = time.Now()
+	}
+	m.Alive = alive
+	m.Left = !alive && n.State == memberlist.StateLeft
+	if meta != nil {
+		m.Meta = *meta
+	}
+	g.lock.Unlock()
+
+	g.changed()
+}
+
+// forget drops a member that has left gossip gracefully.
+func (g *gossip) forget(name string) {
+	g.lock.Lock()
+	delete(g.members, name)
+	g.lock.Unlock()
+}
+
+// changed signals that gossip membership has changed.
+func (g *gossip) changed() {
+	select {
+	case g.changeCh <- struct{}{}:
+	default:
+	}
+}
+
+// NodeMeta implements memberlist.Delegate.
+func (g *gossip) NodeMeta(limit int) []byte {
+	s := g.server
+	b, err := json.Marshal(&nodeMeta{
+		Cluster:  s.config.ClusterName,
+		RaftAddr: s.config.RaftAdvertise,
+		RPCAddr:  s.config.RPCAdvertise,
+		Zone:     s.config.Zone,
+		Version:  Version,
+		NonVoter: s.isNonVoter(),
+	})
+	if err != nil || len(b) > limit {
+		s.logger.Printf("error encoding gossip metadata: %d bytes exceeds %d or %v", len(b), limit, err)
+		return nil
+	}
+
+	return b
+}
+
+// NotifyMsg, GetBroadcasts, LocalState and MergeRemoteState implement
+// memberlist.Delegate. Only node metadata is exchanged.
+func (g *gossip) NotifyMsg([]byte)                           {}
+func (g *gossip) GetBroadcasts(overhead, limit int) [][]byte { return nil }
+func (g *gossip) LocalState(join bool) []byte                { return nil }
+func (g *gossip) MergeRemoteState(buf []byte, join bool)     {}
+
+// NotifyJoin and NotifyUpdate implement memberlist.EventDelegate.
+func (g *gossip) NotifyJoin(n *memberlist.Node)   { g.update(n, true) }
+func (g *gossip) NotifyUpdate(n *memberlist.Node) { g.update(n, true) }
+
+// NotifyLeave implements memberlist.EventDelegate. A member that failed is
+// kept and reported failed. One that left gracefully is kept as left until
+// the leader has removed it from raft, as its own Leave may not have reached
+// the leader.
+func (g *gossip) NotifyLeave(n *memberlist.Node) {
+	g.update(n, false)
+}
+
+// runReconcile keeps raft membership in line with gossip until stopCh is
+// closed. It runs only while the local member leads.
+func (s *Server) runReconcile(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		s.reconcileRound(s.gossip)
+
+		select {
+		case <-s.gossip.changeCh:
+		case <-ticker.C:
+		case <-stopCh:
+			return
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+// reconcileRound adds members that g reports alive but raft does not know,
+// voters and non-voters alike. It removes raft peers that g reports left
+// gracefully, and those it has reported failed for longer than
+// Config.DeadServerThreshold, as long as a quorum of healthy voters remains.
+// Non-voters need no quorum check.
+func (s *Server) reconcileRound(g *gossip) {
+	servers, err := s.servers()
+	if err != nil {
+		s.logger.Printf("reconcile: error reading configuration: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), raftApplyTimeout)
+	defer cancel()
+
+	for _, m := range g.snapshot() {
+		if !m.Alive || m.Meta.Cluster != s.config.ClusterName || m.Meta.RaftAddr == "" || hasServer(servers, m.Name) {
+			continue
+		}
+
+		// Non-voters join raft without a vote. addPeer also keeps members
+		// demoted by zone placement from voting again.
+		s.logger.Printf("reconcile: adding %s at %s reported alive by gossip", m.Name, m.Meta.RaftAddr)
+		_, err := s.addPeer(ctx, &JoinRequest{
+			ID:         m.Name,
+			Address:    m.Meta.RaftAddr,
+			RPCAddress: m.Meta.RPCAddr,
+			Zone:       m.Meta.Zone,
+			NonVoter:   m.Meta.NonVoter,
+		})
+		if err != nil {
+			s.logger.Printf("reconcile: error adding %s: %v", m.Name, err)
+		}
+	}
+
+	// Members that left gracefully meant to go, whatever their suffrage.
+	for _, m := range g.snapshot() {
+		if !m.Left || m.Name == s.id {
+			continue
+		}
+
+		if hasServer(servers, m.Name) {
+			s.logger.Printf("reconcile: removing %s, left gossip", m.Name)
+			if err := s.removePeerLocal(ctx, m.Name); err != nil {
+				s.logger.Printf("reconcile: error removing %s: %v", m.Name, err)
+				return
+			}
+		}
+		g.forget(m.Name)
+	}
+
+	if servers, err = s.servers(); err != nil {
+		s.logger.Printf("reconcile: error reading configuration: %v", err)
+		return
+	}
+
+	health := &ClusterHealth{}
+	for _, srv := range servers {
+		h := &ServerHealth{
+			ID:       string(srv.ID),
+			Address:  string(srv.Address),
+			Leader:   string(srv.ID) == s.id,
+			NonVoter: srv.Suffrage != raft.Voter,
+			Healthy:  true,
+		}
+		if m, ok := g.member(h.ID); ok && !m.Alive {
+			h.Healthy = false
+			h.FailedSince = m.Since
+		}
+
+		health.Servers = append(health.Servers, h)
+		if h.NonVoter {
+			continue
+		}
+
+		health.Voters++
+		if h.Healthy {
+			health.HealthyVoters++
+		}
+	}
+
+	for _, dead := range health.deadServers(s.config.DeadServerThreshold, time.Now()) {
+		s.logger.Printf("reconcile: removing %s, failed in gossip since %v", dead.ID, dead.FailedSince)
+		if err := s.removePeerLocal(ctx, dead.ID); err != nil {
+			s.logger.Printf("reconcile: error removing %s: %v", dead.ID, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package blehdb
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+func TestGossipMembers(t *testing.T) {
+	s := testServer(t, func(c *Config) { c.Zone = "a" })
+	g := &gossip{
+		server:   s,
+		members:  make(map[string]*gossipMember),
+		changeCh: make(chan struct{}, 1),
+	}
+
+	var local nodeMeta
+	if err := json.Unmarshal(g.NodeMeta(512), &local); err != nil {
+		t.Fatalf("error decoding local metadata: %v", err)
+	}
+	if local.RPCAddr != s.config.RPCAdvertise || local.Zone != "a" || local.Version != Version || local.NonVoter {
+		t.Errorf("unexpected local metadata: %+v", local)
+	}
+	if g.NodeMeta(8) != nil {
+		t.Error("expected no metadata when it exceeds the limit")
+	}
+
+	meta, _ := json.Marshal(&nodeMeta{RaftAddr: "10.0.0.2:11000", RPCAddr: "10.0.0.2:12000", Zone: "b"})
+	node := &memberlist.Node{Name: "10.0.0.2:11000", Meta: meta}
+
+	g.NotifyJoin(node)
+	m, ok := g.member(node.Name)
+	if !ok || !m.Alive || m.Meta.Zone != "b" {
+		t.Fatalf("expected alive member in zone b, got: %+v", m)
+	}
+	joined := m.Since
+
+	select {
+	case <-g.changeCh:
+	default:
+		t.Error("expected a change to be signalled")
+	}
+
+	g.NotifyUpdate(node)
+	if m, _ := g.member(node.Name); !m.Since.Equal(joined) {
+		t.Error("an update should not reset when the member was last seen joining")
+	}
+
+	// Metadata that cannot be decoded keeps what was known.
+	g.NotifyUpdate(&memberlist.Node{Name: node.Name, Meta: []byte("{")})
+	if m, _ := g.member(node.Name); m.Meta.Zone != "b" {
+		t.Errorf("expected the previous metadata to be kept, got: %+v", m.Meta)
+	}
+
+	node.State = memberlist.StateDead
+	g.NotifyLeave(node)
+	m, _ = g.member(node.Name)
+	if m.Alive || m.Since.Before(joined) {
+		t.Errorf("expected failed member, got: %+v", m)
+	}
+
+	if members := g.snapshot(); len(members) != 1 || members[0].Name != node.Name {
+		t.Errorf("unexpected members: %+v", members)
+	}
+
+	if m.Left {
+		t.Error("a failed member should not be reported as left")
+	}
+
+	// A member that left is kept until the leader removes it from raft.
+	node.State = memberlist.StateLeft
+	g.NotifyLeave(node)
+	if m, ok := g.member(node.Name); !ok || m.Alive || !m.Left {
+		t.Errorf("expected a member that left, got: %+v", m)
+	}
+
+	node.State = memberlist.StateAlive
+	g.NotifyJoin(node)
+	if m, _ := g.member(node.Name); !m.Alive || m.Left {
+		t.Errorf("expected a member that joined again to be alive, got: %+v", m)
+	}
+}
+
+func TestReconcileNonVoter(t *testing.T) {
+	leader := testServer(t, func(c *Config) { c.Bootstrap = true })
+	waitForLeader(t, leader)
+
+	// The replica finds no seeds to join; it is only known through gossip.
+	replica := testServer(t, func(c *Config) {
+		c.NonVoter = true
+		c.Discoverer = StaticDiscoverer{}
+	})
+
+	// The fake gossip view is handed to reconcileRound directly; the leader
+	// runs no gossip of its own.
+	g := &gossip{
+		server:   leader,
+		members:  make(map[string]*gossipMember),
+		changeCh: make(chan struct{}, 1),
+	}
+
+	// A member gossiping another cluster's name is never added.
+	meta, _ := json.Marshal(&nodeMeta{
+		Cluster:  "other",
+		RaftAddr: replica.config.RaftAdvertise,
+		RPCAddr:  replica.config.RPCAdvertise,
+		NonVoter: true,
+	})
+	g.NotifyJoin(&memberlist.Node{Name: replica.id, Meta: meta})
+
+	leader.reconcileRound(g)
+	if peers, err := leader.servers(); err != nil || hasServer(peers, replica.id) {
+		t.Fatalf("expected a member of another cluster to be ignored, got: %v, %v", peers, err)
+	}
+
+	meta, _ = json.Marshal(&nodeMeta{
+		RaftAddr: replica.config.RaftAdvertise,
+		RPCAddr:  replica.config.RPCAdvertise,
+		NonVoter: true,
+	})
+	g.NotifyUpdate(&memberlist.Node{Name: replica.id, Meta: meta})
+
+	leader.reconcileRound(g)
+
+	voters, nonVoters := voterCount(t, leader)
+	m, ok := leader.fsm.Member(replica.id)
+	if voters != 1 || nonVoters != 1 || !ok || !m.NonVoter {
+		t.Errorf("expected reconcile to add the replica as a raft non-voter, got: %d voters, %d non-voters, %+v", voters, nonVoters, m)
+	}
+}
+
+func TestReconcileRemove(t *testing.T) {
+	servers := testCluster(t, 3, nil)
+	leader, left := servers[0], servers[2]
+
+	replica := testServer(t, func(c *Config) {
+		c.RetryJoin = []string{leader.config.RPCAdvertise}
+		c.NonVoter = true
+	})
+	waitForMembers(t, leader, replica)
+
+	// The voter left gracefully without its Leave reaching the leader, and
+	// the replica failed long ago.
+	left.Close()
+	replica.Close()
+
+	g := &gossip{
+		server: leader,
+		members: map[string]*gossipMember{
+			left.id:    {Name: left.id, Left: true, Since: time.Now()},
+			replica.id: {Name: replica.id, Since: time.Now().Add(-2 * leader.config.DeadServerThreshold)},
+		},
+		changeCh: make(chan struct{}, 1),
+	}
+
+	leader.reconcileRound(g)
+
+	if voters, nonVoters := voterCount(t, leader); voters != 2 || nonVoters != 0 {
+		t.Errorf("expected the voter that left and the dead replica to be removed, got: %d voters, %d non-voters", voters, nonVoters)
+	}
+	for _, id := range []string{left.id, replica.id} {
+		if _, ok := leader.fsm.Member(id); ok {
+			t.Errorf("expected %s to have been deregistered", id)
+		}
+	}
+
+	if _, ok := g.member(left.id); ok {
+		t.Error("expected the member that left to be forgotten once removed")
+	}
+	if _, ok := g.member(replica.id); !ok {
+		t.Error("expected the failed replica to still be reported")
+	}
+}
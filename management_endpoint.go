@@ -1,21 +1,252 @@
 package blehdb
 
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
 type Management struct {
 	server *Server
 }
 
 type JoinRequest struct {
+	// ID is the joining member's server ID. Members that predate server IDs
+	// leave it empty and are known by their raft address.
+	ID         string
+	Address    string
+	RPCAddress string
+	Zone       string
+
+	// NonVoter adds a new member as a raft non-voter. It does not demote a
+	// member that already votes, so a promoted replica keeps its vote when it
+	// joins again.
+	NonVoter bool
+}
+
+// JoinResponse describes the cluster a member has joined.
+type JoinResponse struct {
+	Leader string
+	Peers  []string
+}
+
+// Join adds a member to the cluster. It may be called on any member;
+// followers forward the join to the leader. Joining a member that is already a
+// peer succeeds without changing anything, except that a non-voter joining as
+// a voter is promoted unless zone placement demoted it.
+func (m *Management) Join(args *JoinRequest, reply *JoinResponse) error {
+	ctx, cancel := context.WithTimeout(context.Background(), raftApplyTimeout)
+	defer cancel()
+
+	resp, err := m.server.addPeer(ctx, args)
+	if err != nil {
+		return err
+	}
+
+	*reply = *resp
+
+	return nil
+}
+
+// AddNonVoter adds a read replica. Replicas are raft non-voters: they receive
+// the committed log but take no part in elections or quorum.
+func (m *Management) AddNonVoter(args *JoinRequest, reply *JoinResponse) error {
+	nonVoter := *args
+	nonVoter.NonVoter = true
+
+	return m.Join(&nonVoter, reply)
+}
+
+// RemovePeerRequest names the member to remove by server ID or, failing that,
+// by raft address.
+type RemovePeerRequest struct {
+	ID      string
 	Address string
 }
 
-func (m *Management) Join(args *JoinRequest, reply *string) error {
-	f := m.server.raft.AddPeer(args.Address)
+// RemovePeer removes a member, such as a node that has died permanently, from
+// the cluster. It may be called on any member.
+func (m *Management) RemovePeer(args *RemovePeerRequest, reply *string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), raftApplyTimeout)
+	defer cancel()
+
+	id := args.ID
+	if id == "" {
+		id = args.Address
+	}
+
+	if err := m.server.RemovePeer(ctx, id); err != nil {
+		return err
+	}
+
+	*reply = "Peer Removed"
+
+	return nil
+}
+
+type BootstrapRequest struct {
+	Servers []raft.Server
+}
+
+// Bootstrap hands the initial configuration to a member started with
+// Config.BootstrapExpect, once enough members have joined.
+func (m *Management) Bootstrap(args *BootstrapRequest, reply *string) error {
+	if err := m.server.bootstrapPeers(args.Servers); err != nil {
+		return err
+	}
+
+	*reply = "Peers Set"
+
+	return nil
+}
+
+type TransferLeadershipRequest struct {
+	Target string
+}
+
+// TransferLeadership hands leadership to the member with the given server ID,
+// or to the most caught up voting member when no target is given.
+func (m *Management) TransferLeadership(args *TransferLeadershipRequest, reply *string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if err := m.server.TransferLeadership(ctx, args.Target); err != nil {
+		return err
+	}
+
+	*reply = "Leadership Transferred"
+
+	return nil
+}
+
+type ProgressRequest struct{}
+
+// ProgressResponse describes how far a member has replicated the log.
+type ProgressResponse struct {
+	ID           string
+	Address      string
+	Leader       string
+	AppliedIndex uint64
+	LastContact  time.Time
+}
+
+// Progress reports the local member's replication progress.
+func (m *Management) Progress(args *ProgressRequest, reply *ProgressResponse) error {
+	*reply = *m.server.localProgress()
+
+	return nil
+}
+
+type StatusRequest struct{}
+
+// Status reports the local member's raft state and view of the cluster.
+func (m *Management) Status(args *StatusRequest, reply *Status) error {
+	status, err := m.server.Status()
+	if err != nil {
+		return err
+	}
+
+	*reply = *status
+
+	return nil
+}
+
+type ClusterHealthRequest struct{}
+
+// ClusterHealth reports the leader's autopilot view of the cluster. Like
+// Apply, it fails with raft.ErrNotLeader if this member is not the leader.
+func (m *Management) ClusterHealth(args *ClusterHealthRequest, reply *ClusterHealth) error {
+	if m.server.raft.State() != raft.Leader {
+		return raft.ErrNotLeader
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), raftApplyTimeout)
+	defer cancel()
+
+	health, err := m.server.ClusterHealth(ctx)
+	if err != nil {
+		return err
+	}
+
+	*reply = *health
+
+	return nil
+}
+
+type SnapshotRequest struct{}
+
+func (m *Management) Snapshot(args *SnapshotRequest, reply *string) error {
+	if err := m.server.Snapshot(); err != nil {
+		return err
+	}
+
+	*reply = "Snapshot Taken"
+
+	return nil
+}
+
+// ApplyRequest carries an encoded command forwarded by a follower.
+type ApplyRequest struct {
+	Message []byte
+}
+
+type ApplyResponse struct {
+	Token ConsistencyToken
+}
+
+// Apply applies a command forwarded by a follower. It fails with
+// raft.ErrNotLeader if this member is not the leader, letting the follower
+// retry against the new leader. Only the data mutations followers forward are
+// accepted; membership changes have RPCs of their own.
+func (m *Management) Apply(args *ApplyRequest, reply *ApplyResponse) error {
+	if !forwardable(args.Message) {
+		return fmt.Errorf("message cannot be forwarded")
+	}
+
+	if m.server.raft.State() != raft.Leader {
+		return raft.ErrNotLeader
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), raftApplyTimeout)
+	defer cancel()
+
+	token, err := m.server.applyRaft(ctx, args.Message)
+	reply.Token = token
+
+	return err
+}
+
+// ReadRequest carries a consistent read forwarded by a follower.
+type ReadRequest struct {
+	Bucket  string
+	Key     string
+	Options ReadOptions
+}
+
+type ReadResponse struct {
+	Value string
+	Meta  ReadMeta
+}
+
+// Read serves a read forwarded by a follower. Like Apply, it fails with
+// raft.ErrNotLeader if this member is not the leader.
+func (m *Management) Read(args *ReadRequest, reply *ReadResponse) error {
+	if m.server.raft.State() != raft.Leader {
+		return raft.ErrNotLeader
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), raftApplyTimeout)
+	defer cancel()
 
-	if f.Error() != nil {
-		return f.Error()
+	val, meta, err := m.server.consistentGet(ctx, args.Bucket, args.Key, &args.Options)
+	if err != nil {
+		return err
 	}
 
-	*reply = "Peer Added"
+	reply.Value = val
+	reply.Meta = *meta
 
 	return nil
 }
@@ -0,0 +1,265 @@
+package blehdb
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// leavePollInterval is how often Leave checks whether the local member has
+// seen its own removal.
+const leavePollInterval = 50 * time.Millisecond
+
+// joinID returns the server ID of a joining member. Members that predate
+// server IDs are known by their raft address.
+func joinID(args *JoinRequest) string {
+	if args.ID != "" {
+		return args.ID
+	}
+
+	return args.Address
+}
+
+// servers returns the servers in the latest raft configuration.
+func (s *Server) servers() ([]raft.Server, error) {
+	future := s.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+
+	return future.Configuration().Servers, nil
+}
+
+// hasServer reports whether a server with the given ID is part of the
+// configuration.
+func hasServer(servers []raft.Server, id string) bool {
+	for _, srv := range servers {
+		if string(srv.ID) == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isVoter reports whether the server with the given ID is a voter in the
+// configuration.
+func isVoter(servers []raft.Server, id string) bool {
+	for _, srv := range servers {
+		if string(srv.ID) == id {
+			return srv.Suffrage == raft.Voter
+		}
+	}
+
+	return false
+}
+
+// serverByAddr returns the server with the given raft address.
+func serverByAddr(servers []raft.Server, addr string) (raft.Server, bool) {
+	for _, srv := range servers {
+		if string(srv.Address) == addr {
+			return srv, true
+		}
+	}
+
+	return raft.Server{}, false
+}
+
+// serverAddrs returns the raft addresses of the servers.
+func serverAddrs(servers []raft.Server) []string {
+	addrs := make([]string, 0, len(servers))
+	for _, srv := range servers {
+		addrs = append(addrs, string(srv.Address))
+	}
+
+	return addrs
+}
+
+// addPeer adds a member to the cluster, forwarding the join to the leader when
+// necessary.
+func (s *Server) addPeer(ctx context.Context, args *JoinRequest) (*JoinResponse, error) {
+	if s.handleExpectJoin(args) {
+		return &JoinResponse{
+			Peers: s.expect.known(),
+		}, nil
+	}
+
+	id := joinID(args)
+
+	var resp JoinResponse
+	err := s.retryLeader(ctx, func() error {
+		if s.raft.State() != raft.Leader {
+			return s.forwardToLeader(ctx, "Management.Join", args, &resp)
+		}
+
+		servers, err := s.servers()
+		if err != nil {
+			return err
+		}
+
+		// A member that was rebuilt with a fresh ID reuses its old address;
+		// the stale entry would otherwise count towards quorum forever.
+		if srv, ok := serverByAddr(servers, args.Address); ok && string(srv.ID) != id {
+			s.logger.Printf("Replacing server %s at %s with %s", srv.ID, args.Address, id)
+			if err := s.removePeerLocal(ctx, string(srv.ID)); err != nil {
+				return err
+			}
+		}
+
+		// A member demoted by zone placement stays a non-voter when it joins
+		// again; only placement promotes it.
+		m, ok := s.fsm.Member(id)
+		demoted := ok && m.Demoted
+
+		switch {
+		case !hasServer(servers, id) && (args.NonVoter || demoted):
+			err := s.raft.AddNonvoter(raft.ServerID(id), raft.ServerAddress(args.Address), 0, 0).Error()
+			if err != nil {
+				return err
+			}
+		case !args.NonVoter && !demoted && !isVoter(servers, id):
+			if err := s.checkStable(id); err != nil {
+				return err
+			}
+
+			err := s.raft.AddVoter(raft.ServerID(id), raft.ServerAddress(args.Address), 0, 0).Error()
+			if err != nil {
+				return err
+			}
+		}
+
+		servers, err = s.servers()
+		if err != nil {
+			return err
+		}
+
+		if args.RPCAddress != "" {
+			want := &member{
+				ID:       id,
+				RaftAddr: args.Address,
+				RPCAddr:  args.RPCAddress,
+				NonVoter: !isVoter(servers, id),
+				Zone:     args.Zone,
+				Demoted:  demoted,
+			}
+
+			if !ok || *m != *want {
+				if err := s.registerMember(ctx, want); err != nil {
+					return err
+				}
+			}
+		}
+
+		resp = JoinResponse{
+			Leader: string(s.raft.Leader()),
+			Peers:  serverAddrs(servers),
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+// RemovePeer removes the member with the given server ID from the cluster. A
+// raft address is accepted in place of the ID. It can be called on any member;
+// followers forward the request to the leader. Removing a member that is not a
+// peer is not an error.
+func (s *Server) RemovePeer(ctx context.Context, id string) error {
+	return s.retryLeader(ctx, func() error {
+		if s.raft.State() == raft.Leader {
+			return s.removePeerLocal(ctx, id)
+		}
+
+		var reply string
+		return s.forwardToLeader(ctx, "Management.RemovePeer", &RemovePeerRequest{ID: id}, &reply)
+	})
+}
+
+func (s *Server) removePeerLocal(ctx context.Context, id string) error {
+	servers, err := s.servers()
+	if err != nil {
+		return err
+	}
+
+	if !hasServer(servers, id) {
+		if srv, ok := serverByAddr(servers, id); ok {
+			id = string(srv.ID)
+		} else if m, ok := s.fsm.MemberByAddr(id); ok {
+			id = m.ID
+		}
+	}
+
+	// Deregister first: once the leader has removed itself it can no longer
+	// commit anything.
+	if _, ok := s.fsm.Member(id); ok {
+		b, err := encodeMessage(DeregisterMemberRequestType, &member{ID: id})
+		if err != nil {
+			return err
+		}
+
+		if _, err := s.applyRaft(ctx, b); err != nil {
+			return err
+		}
+	}
+
+	if !hasServer(servers, id) {
+		return nil
+	}
+
+	return s.raft.RemoveServer(raft.ServerID(id), 0, 0).Error()
+}
+
+// Leave removes the local member from the cluster. A leader first transfers
+// leadership to the most caught up member. Leave returns once the local member
+// has applied its own removal.
+func (s *Server) Leave(ctx context.Context) error {
+	servers, err := s.servers()
+	if err != nil {
+		return err
+	}
+
+	if len(servers) == 0 || (len(servers) == 1 && hasServer(servers, s.id)) {
+		s.logger.Println("No other peers, skipping leave")
+		return nil
+	}
+
+	s.logger.Println("Leaving the cluster")
+
+	// Hand leadership over first, so that the cluster does not have to wait
+	// out an election, and leave as a follower. Another member winning the
+	// election instead of the chosen one is fine.
+	if s.raft.State() == raft.Leader {
+		if err := s.transferLeadership(ctx, ""); err != nil && s.raft.State() == raft.Leader {
+			return err
+		}
+	}
+
+	if err := s.RemovePeer(ctx, s.id); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(leavePollInterval)
+	defer ticker.Stop()
+
+	for {
+		if s.raft.State() == raft.Shutdown {
+			return nil
+		}
+
+		servers, err := s.servers()
+		if err == nil && !hasServer(servers, s.id) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package blehdb
+
+import (
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+// waitForDeparture waits until s is neither a raft peer nor registered on any
+// of the remaining servers, and one of them is leader.
+func waitForDeparture(t *testing.T, s *Server, remaining ...*Server) {
+	waitFor(t, s.id+" to leave", func() bool {
+		for _, other := range remaining {
+			peers, err := other.servers()
+			if err != nil || hasServer(peers, s.id) {
+				return false
+			}
+			if _, ok := other.fsm.Member(s.id); ok {
+				return false
+			}
+		}
+		return true
+	})
+	waitForLeader(t, remaining...)
+}
+
+func TestLeaveFollower(t *testing.T) {
+	servers := testCluster(t, 3, nil)
+	leader := servers[0]
+	ctx := testContext(t)
+
+	if err := servers[2].Leave(ctx); err != nil {
+		t.Fatalf("error leaving: %v", err)
+	}
+
+	waitForDeparture(t, servers[2], servers[0], servers[1])
+
+	if leader.raft.State() != raft.Leader {
+		t.Error("a follower leaving should not change the leader")
+	}
+}
+
+func TestLeaveLeader(t *testing.T) {
+	servers := testCluster(t, 3, nil)
+	leader := servers[0]
+	ctx := testContext(t)
+
+	if _, err := leader.CreateBucket(ctx, "foo"); err != nil {
+		t.Fatalf("error creating bucket: %v", err)
+	}
+
+	if err := leader.Leave(ctx); err != nil {
+		t.Fatalf("error leaving: %v", err)
+	}
+
+	// Leadership was handed over before leaving, so the rest already have a
+	// leader.
+	if leader.raft.State() == raft.Leader {
+		t.Error("the former leader should have stepped down")
+	}
+
+	waitForDeparture(t, leader, servers[1], servers[2])
+
+	if _, err := servers[1].Set(ctx, "foo", "bar", "baz"); err != nil {
+		t.Errorf("error writing after the leader left: %v", err)
+	}
+}
+
+func TestLeaveSingleNode(t *testing.T) {
+	s := testServer(t, func(c *Config) { c.Bootstrap = true })
+	waitForLeader(t, s)
+
+	if err := s.Leave(testContext(t)); err != nil {
+		t.Errorf("leaving a single node cluster should succeed, got: %v", err)
+	}
+
+	if s.raft.State() != raft.Leader {
+		t.Error("the only member should stay leader")
+	}
+}
+
+func TestJoinThroughFollower(t *testing.T) {
+	servers := testCluster(t, 2, nil)
+	leader, follower := servers[0], servers[1]
+	ctx := testContext(t)
+
+	// The new member has no seeds; it is joined through the follower, which
+	// forwards the join to the leader.
+	s := testServer(t, nil)
+	args := &JoinRequest{
+		ID:         s.id,
+		Address:    s.config.RaftAdvertise,
+		RPCAddress: s.config.RPCAdvertise,
+	}
+
+	var resp JoinResponse
+	if err := follower.callRPC(ctx, follower.config.RPCAdvertise, "Management.Join", args, &resp); err != nil {
+		t.Fatalf("error joining through the follower: %v", err)
+	}
+
+	if resp.Leader != leader.config.RaftAdvertise {
+		t.Errorf("expected the reply to name leader %s, got: %s", leader.config.RaftAdvertise, resp.Leader)
+	}
+
+	want := map[string]bool{
+		leader.config.RaftAdvertise:   true,
+		follower.config.RaftAdvertise: true,
+		s.config.RaftAdvertise:        true,
+	}
+	if len(resp.Peers) != len(want) {
+		t.Fatalf("expected the reply to list %d peers, got: %v", len(want), resp.Peers)
+	}
+	for _, peer := range resp.Peers {
+		if !want[peer] {
+			t.Errorf("unexpected peer %s in reply: %v", peer, resp.Peers)
+		}
+	}
+
+	waitForMembers(t, leader, follower, s)
+}
@@ -0,0 +1,171 @@
+package blehdb
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// With Config.SinglePort, every connection to the RPC listener starts with a
+// byte naming the protocol that follows. New protocols can be added by giving
+// them a byte of their own.
+const (
+	muxRPC  byte = 0x01
+	muxRaft byte = 0x02
+)
+
+// muxHandshakeTimeout bounds how long an accepted connection may take to send
+// its protocol byte.
+const muxHandshakeTimeout = 5 * time.Second
+
+// errLayerClosed is returned by Accept once the raft layer has been closed.
+var errLayerClosed = errors.New("raft layer is closed")
+
+// raftLayer is the raft StreamLayer used with Config.SinglePort. It dials raft
+// connections with the raft protocol byte and accepts those handed over by
+// the RPC listener.
+type raftLayer struct {
+	addr   net.Addr
+	connCh chan net.Conn
+
+	closeOnce sync.Once
+	closeCh   chan struct{}
+}
+
+func newRaftLayer(addr net.Addr) *raftLayer {
+	return &raftLayer{
+		addr:    addr,
+		connCh:  make(chan net.Conn),
+		closeCh: make(chan struct{}),
+	}
+}
+
+// handoff passes a raft connection accepted by the RPC listener to raft.
+func (l *raftLayer) handoff(conn net.Conn) error {
+	select {
+	case l.connCh <- conn:
+		return nil
+	case <-l.closeCh:
+		return errLayerClosed
+	}
+}
+
+func (l *raftLayer) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.connCh:
+		return conn, nil
+	case <-l.closeCh:
+		return nil, errLayerClosed
+	}
+}
+
+func (l *raftLayer) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closeCh)
+	})
+	return nil
+}
+
+// Addr returns the address raft advertises, which is the RPC address.
+func (l *raftLayer) Addr() net.Addr {
+	return l.addr
+}
+
+func (l *raftLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	return dialMux(string(address), muxRaft, timeout)
+}
+
+// dialMux dials addr and announces the protocol that follows.
+func dialMux(addr string, protocol byte, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write([]byte{protocol}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// dialRPC dials the RPC server of another member.
+func (s *Server) dialRPC(addr string, timeout time.Duration) (net.Conn, error) {
+	if s.config.SinglePort {
+		return dialMux(addr, muxRPC, timeout)
+	}
+
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+// handleMux reads the protocol byte of a connection accepted with
+// Config.SinglePort and dispatches it.
+func (s *Server) handleMux(conn net.Conn) {
+	buf := make([]byte, 1)
+	conn.SetReadDeadline(time.Now().Add(muxHandshakeTimeout))
+	if _, err := conn.Read(buf); err != nil {
+		s.logger.Printf("error reading protocol from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	switch buf[0] {
+	case muxRPC:
+		s.trackConn(conn)
+		s.serveConn(conn)
+	case muxRaft:
+		s.trackConn(conn)
+		tracked := &muxConn{Conn: conn, untrack: func() { s.untrackConn(conn) }}
+		if err := s.raftLayer.handoff(tracked); err != nil {
+			tracked.Close()
+		}
+	default:
+		s.logger.Printf("unknown protocol %#x from %s", buf[0], conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+// muxConn is a raft connection handed over by the RPC listener. It stays
+// tracked, so that shutdown closes it, until raft closes it.
+type muxConn struct {
+	net.Conn
+
+	closeOnce sync.Once
+	untrack   func()
+}
+
+func (c *muxConn) Close() error {
+	c.closeOnce.Do(c.untrack)
+	return c.Conn.Close()
+}
+
+// checkSinglePort fails when Config.SinglePort has been turned on or off for a
+// member that already has raft state. The stored configuration still lists the
+// member at the raft address of the other mode, where nothing listens anymore.
+func (s *Server) checkSinglePort() error {
+	servers, err := s.servers()
+	if err != nil {
+		return err
+	}
+
+	other := s.config.RPCAdvertise
+	if s.config.SinglePort {
+		if other, err = advertiseAddr(s.config.RaftBind, ""); err != nil {
+			return nil
+		}
+	}
+
+	for _, srv := range servers {
+		if string(srv.ID) == s.id && string(srv.Address) == other {
+			return fmt.Errorf("the raft configuration lists this member at %s, but it now serves raft on %s: SinglePort cannot be changed for an existing member", srv.Address, s.config.RaftAdvertise)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,143 @@
+package blehdb
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+type muxEcho struct{}
+
+func (muxEcho) Echo(args string, reply *string) error {
+	*reply = args
+	return nil
+}
+
+func tracked(s *Server, conn net.Conn) bool {
+	s.rpcLock.Lock()
+	defer s.rpcLock.Unlock()
+
+	_, ok := s.rpcConns[conn]
+	return ok
+}
+
+func TestSinglePortDispatch(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+
+	s := &Server{
+		config:      &Config{SinglePort: true},
+		logger:      log.New(os.Stdout, "[BLEHDB] ", log.LstdFlags),
+		rpcListener: l,
+		rpcServer:   rpc.NewServer(),
+		rpcConns:    make(map[net.Conn]struct{}),
+		raftLayer:   newRaftLayer(l.Addr()),
+		shutdownCh:  make(chan struct{}),
+	}
+	s.rpcServer.RegisterName("Echo", muxEcho{})
+
+	go s.listen()
+	defer func() {
+		close(s.shutdownCh)
+		l.Close()
+		s.raftLayer.Close()
+	}()
+
+	addr := l.Addr().String()
+
+	conn, err := s.dialRPC(addr, time.Second)
+	if err != nil {
+		t.Fatalf("error dialing RPC: %v", err)
+	}
+
+	client := rpc.NewClient(conn)
+	defer client.Close()
+
+	var reply string
+	if err := client.Call("Echo.Echo", "hello", &reply); err != nil || reply != "hello" {
+		t.Fatalf("expected RPC to be served, got: '%s', %v", reply, err)
+	}
+
+	raftConn, err := s.raftLayer.Dial(raft.ServerAddress(addr), time.Second)
+	if err != nil {
+		t.Fatalf("error dialing raft: %v", err)
+	}
+	defer raftConn.Close()
+
+	if _, err := raftConn.Write([]byte("ping")); err != nil {
+		t.Fatalf("error writing to raft connection: %v", err)
+	}
+
+	accepted, err := s.raftLayer.Accept()
+	if err != nil {
+		t.Fatalf("error accepting raft connection: %v", err)
+	}
+	defer accepted.Close()
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(accepted, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("expected raft connection to be handed over, got: '%s', %v", buf, err)
+	}
+
+	// A handed over connection is closed on shutdown until raft closes it.
+	handed := accepted.(*muxConn).Conn
+	if !tracked(s, handed) {
+		t.Error("expected the raft connection to be tracked")
+	}
+	accepted.Close()
+	if tracked(s, handed) {
+		t.Error("expected the raft connection to be forgotten once closed")
+	}
+
+	unknown, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("error dialing: %v", err)
+	}
+	defer unknown.Close()
+
+	unknown.Write([]byte{0xff})
+	unknown.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := unknown.Read(buf); err != io.EOF {
+		t.Errorf("expected an unknown protocol to be closed, got: %v", err)
+	}
+
+	s.raftLayer.Close()
+	if _, err := s.raftLayer.Accept(); err != errLayerClosed {
+		t.Errorf("expected Accept to fail once closed, got: %v", err)
+	}
+}
+
+func TestSinglePortExistingMember(t *testing.T) {
+	for _, singlePort := range []bool{false, true} {
+		config := testConfig(t)
+		config.Bootstrap = true
+		config.SinglePort = singlePort
+
+		s := startServer(t, config)
+		waitForLeader(t, s)
+		if err := s.Close(); err != nil {
+			t.Fatalf("error closing server: %v", err)
+		}
+
+		// The stored configuration still has the raft address of the other
+		// mode.
+		config.SinglePort = !singlePort
+		if s, err := NewServer(config); err == nil {
+			s.Close()
+			t.Errorf("expected turning SinglePort to %v to be rejected for an existing member", !singlePort)
+		}
+
+		// Switching back finds the address the configuration expects.
+		config.SinglePort = singlePort
+		s = startServer(t, config)
+		waitForLeader(t, s)
+	}
+}
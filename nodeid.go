@@ -0,0 +1,113 @@
+package blehdb
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// nodeIDFile holds the server ID inside Config.StorageDir.
+	nodeIDFile = "node-id"
+
+	// legacyPeersFile is where the deprecated JSONPeers store kept the peer
+	// set, keyed by raft address.
+	legacyPeersFile = "peers.json"
+)
+
+// loadNodeID returns the persistent server ID stored in dir, creating it on
+// first start. A member that predates server IDs, recognisable by its
+// peers.json, keeps its raft address as its ID so that it matches the IDs raft
+// derives when migrating the peer sets of the other members.
+func loadNodeID(dir, raftAddr string) (string, error) {
+	path := filepath.Join(dir, nodeIDFile)
+
+	b, err := ioutil.ReadFile(path)
+	if err == nil {
+		id := strings.TrimSpace(string(b))
+		if id == "" {
+			return "", fmt.Errorf("%s is empty", path)
+		}
+		return id, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	var id string
+	if _, err := os.Stat(filepath.Join(dir, legacyPeersFile)); err == nil {
+		id = raftAddr
+	} else {
+		id, err = generateID()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	if err := ioutil.WriteFile(path, []byte(id+"\n"), 0644); err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// generateID returns a random UUID.
+func generateID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", buf[0:4], buf[4:6], buf[6:8], buf[8:10], buf[10:16]), nil
+}
+
+// migratePeers carries the peer set of a member that predates server IDs over
+// into its raft configuration. The peers.json file is renamed afterwards so
+// that the migration happens only once. As with any recovery of a raft
+// configuration, every member should be stopped and migrated before the
+// cluster is started again.
+func (s *Server) migratePeers(conf *raft.Config, snapshots raft.SnapshotStore) error {
+	path := filepath.Join(s.config.StorageDir, legacyPeersFile)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	configuration, err := raft.ReadPeersJSON(path)
+	if err != nil {
+		return fmt.Errorf("reading %s: %v", path, err)
+	}
+
+	// A single node cluster had no peers recorded besides itself.
+	if len(configuration.Servers) == 0 {
+		configuration.Servers = []raft.Server{{
+			Suffrage: raft.Voter,
+			ID:       raft.ServerID(s.id),
+			Address:  s.transport.LocalAddr(),
+		}}
+	}
+
+	s.logger.Printf("Migrating %d peers from %s into the raft configuration", len(configuration.Servers), path)
+
+	// Recovery replays the log into a throwaway FSM; the real one is restored
+	// from the resulting snapshot when raft starts.
+	fsm, err := NewFSM()
+	if err != nil {
+		return err
+	}
+	fsm.keyring = s.fsm.keyring
+
+	if err := raft.RecoverCluster(conf, fsm, s.raftStore, s.raftStore, snapshots, s.transport, configuration); err != nil {
+		return fmt.Errorf("migrating %s: %v", path, err)
+	}
+
+	return os.Rename(path, path+".migrated")
+}
@@ -0,0 +1,56 @@
+package blehdb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadNodeID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blehdb-nodeid")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	id, err := loadNodeID(dir, "127.0.0.1:11000")
+	if err != nil {
+		t.Fatalf("error loading node ID: %v", err)
+	}
+
+	if id == "" || id == "127.0.0.1:11000" {
+		t.Fatalf("expected a generated ID, got: '%s'", id)
+	}
+
+	again, err := loadNodeID(dir, "127.0.0.2:11000")
+	if err != nil {
+		t.Fatalf("error loading node ID: %v", err)
+	}
+
+	if again != id {
+		t.Errorf("ID should persist across restarts, got: '%s' then '%s'", id, again)
+	}
+}
+
+func TestLoadNodeIDLegacy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blehdb-nodeid")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	peers := []byte(`["127.0.0.1:11000","127.0.0.2:11000"]`)
+	if err := ioutil.WriteFile(filepath.Join(dir, legacyPeersFile), peers, 0644); err != nil {
+		t.Fatalf("error writing peers: %v", err)
+	}
+
+	id, err := loadNodeID(dir, "127.0.0.1:11000")
+	if err != nil {
+		t.Fatalf("error loading node ID: %v", err)
+	}
+
+	if id != "127.0.0.1:11000" {
+		t.Errorf("a legacy member should keep its raft address as ID, got: '%s'", id)
+	}
+}
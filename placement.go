@@ -0,0 +1,258 @@
+package blehdb
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// placementInterval is how often the leader rechecks voter placement when no
+// membership change prompts it sooner.
+const placementInterval = 10 * time.Second
+
+// zoneVoterCap returns the largest number of voters each zone may hold such
+// that losing any one zone leaves a quorum of the voters chosen. It returns 0
+// when no cap achieves that, which is the case with fewer than three zones.
+func zoneVoterCap(zoneSizes map[string]int) int {
+	largest := 0
+	for _, n := range zoneSizes {
+		if n > largest {
+			largest = n
+		}
+	}
+
+	for c := largest; c > 0; c-- {
+		voters := 0
+		for _, n := range zoneSizes {
+			if n < c {
+				voters += n
+			} else {
+				voters += c
+			}
+		}
+
+		if voters-c >= quorum(voters) {
+			return c
+		}
+	}
+
+	return 0
+}
+
+// placeVoters chooses which of the candidate members should vote. Within each
+// zone the leader is kept first, then members that already vote, so that as
+// few members as possible change role.
+func placeVoters(candidates []*member, leader string) (map[string]bool, error) {
+	zones := make(map[string][]*member)
+	sizes := make(map[string]int)
+	for _, m := range candidates {
+		if m.Zone == "" {
+			return nil, fmt.Errorf("%s has no zone", m.ID)
+		}
+		zones[m.Zone] = append(zones[m.Zone], m)
+		sizes[m.Zone]++
+	}
+
+	c := zoneVoterCap(sizes)
+	if c == 0 {
+		return nil, fmt.Errorf("members span %d zones, at least 3 are needed to survive the loss of a zone", len(zones))
+	}
+
+	voters := make(map[string]bool)
+	for _, members := range zones {
+		sort.Slice(members, func(i, j int) bool {
+			a, b := members[i], members[j]
+			if (a.ID == leader) != (b.ID == leader) {
+				return a.ID == leader
+			}
+			if a.NonVoter != b.NonVoter {
+				return !a.NonVoter
+			}
+			return a.ID < b.ID
+		})
+
+		for i := 0; i < c && i < len(members); i++ {
+			voters[members[i].ID] = true
+		}
+	}
+
+	return voters, nil
+}
+
+// runPlacement keeps voters spread across zones until stopCh is closed. It
+// runs only while the local member leads.
+func (s *Server) runPlacement(stopCh <-chan struct{}) {
+	events, cancel := s.Subscribe()
+	defer cancel()
+
+	ticker := time.NewTicker(placementInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.placementRound(); err != nil {
+			s.logger.Printf("zone placement: %v", err)
+		}
+
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if e.Type != EventPeerAdded && e.Type != EventPeerRemoved {
+				continue
+			}
+		case <-ticker.C:
+		case <-stopCh:
+			return
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+// placementRound promotes and demotes members to match placeVoters. Members
+// are promoted before any are demoted, so quorum never shrinks mid-way.
+func (s *Server) placementRound() error {
+	servers, err := s.servers()
+	if err != nil {
+		return err
+	}
+
+	var candidates []*member
+	registered := make(map[string]bool)
+	for _, m := range s.fsm.Members() {
+		registered[m.ID] = true
+		if isVoter(servers, m.ID) || (m.Demoted && hasServer(servers, m.ID)) {
+			candidates = append(candidates, m)
+		}
+	}
+	for _, srv := range servers {
+		if !registered[string(srv.ID)] {
+			return fmt.Errorf("%s is not registered yet", srv.ID)
+		}
+	}
+
+	voters, err := placeVoters(candidates, s.id)
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].ID < candidates[j].ID
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), raftApplyTimeout)
+	defer cancel()
+
+	for _, m := range candidates {
+		if voters[m.ID] && m.Demoted {
+			if err := s.checkStable(m.ID); err != nil {
+				s.logger.Printf("zone placement: not promoting yet: %v", err)
+				continue
+			}
+
+			s.logger.Printf("zone placement: promoting %s in zone %s", m.ID, m.Zone)
+			if err := s.promoteMember(ctx, m); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, m := range candidates {
+		if !voters[m.ID] && isVoter(servers, m.ID) {
+			s.logger.Printf("zone placement: demoting %s in zone %s", m.ID, m.Zone)
+			if err := s.demoteMember(ctx, m); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// demoteMember turns a voter into a non-voter. It stays a raft peer and keeps
+// receiving the log, but no longer counts towards quorum. It is marked as
+// demoted in the registry so that only placement promotes it again.
+func (s *Server) demoteMember(ctx context.Context, m *member) error {
+	err := s.raft.DemoteVoter(raft.ServerID(m.ID), 0, 0).Error()
+	if err != nil {
+		return err
+	}
+
+	return s.registerMember(ctx, &member{
+		ID:       m.ID,
+		RaftAddr: m.RaftAddr,
+		RPCAddr:  m.RPCAddr,
+		Zone:     m.Zone,
+		NonVoter: true,
+		Demoted:  true,
+	})
+}
+
+// promoteMember turns a demoted member back into a voter.
+func (s *Server) promoteMember(ctx context.Context, m *member) error {
+	err := s.raft.AddVoter(raft.ServerID(m.ID), raft.ServerAddress(m.RaftAddr), 0, 0).Error()
+	if err != nil {
+		return err
+	}
+
+	return s.registerMember(ctx, &member{
+		ID:       m.ID,
+		RaftAddr: m.RaftAddr,
+		RPCAddr:  m.RPCAddr,
+		Zone:     m.Zone,
+	})
+}
+
+// watchRole follows the local member's entry in the registry, so that gossip
+// advertises its role after zone placement changes it. Whenever a new leader
+// is seen, the member makes sure its zone is registered.
+func (s *Server) watchRole() {
+	events, cancel := s.Subscribe()
+	defer cancel()
+
+	for e := range events {
+		if e.Type == EventLeaderChanged {
+			s.registerZone(e.Leader)
+			continue
+		}
+
+		if e.Peer != s.id || (e.Type != EventPeerDemoted && e.Type != EventPeerPromoted) {
+			continue
+		}
+
+		if s.gossip != nil {
+			s.gossip.updateMeta()
+		}
+	}
+}
+
+// registerZone joins the leader again if the registry does not hold the local
+// member's zone, as happens to members of a cluster formed by BootstrapExpect.
+func (s *Server) registerZone(leader string) {
+	if leader == "" || leader == s.config.RaftAdvertise || s.isNonVoter() {
+		return
+	}
+
+	if m, ok := s.fsm.Member(s.id); ok && m.Zone == s.config.Zone {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), raftApplyTimeout)
+	defer cancel()
+
+	args := &JoinRequest{
+		ID:         s.id,
+		Address:    s.config.RaftAdvertise,
+		RPCAddress: s.config.RPCAdvertise,
+		Zone:       s.config.Zone,
+	}
+
+	var resp JoinResponse
+	if err := s.forwardToLeader(ctx, "Management.Join", args, &resp); err != nil {
+		s.logger.Printf("error registering zone with leader %s: %v", leader, err)
+	}
+}
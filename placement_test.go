@@ -0,0 +1,135 @@
+package blehdb
+
+import (
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestZoneVoterCap(t *testing.T) {
+	cases := []struct {
+		sizes map[string]int
+		cap   int
+	}{
+		{map[string]int{"a": 3}, 0},
+		{map[string]int{"a": 2, "b": 1}, 0},
+		{map[string]int{"a": 1, "b": 1, "c": 1}, 1},
+		{map[string]int{"a": 3, "b": 1, "c": 1}, 1},
+		{map[string]int{"a": 2, "b": 2, "c": 1}, 2},
+		{map[string]int{"a": 2, "b": 2, "c": 2}, 2},
+	}
+
+	for _, c := range cases {
+		if got := zoneVoterCap(c.sizes); got != c.cap {
+			t.Errorf("%v: expected cap %d, got: %d", c.sizes, c.cap, got)
+		}
+	}
+}
+
+func TestPlaceVoters(t *testing.T) {
+	candidates := []*member{
+		{ID: "a1", Zone: "a"},
+		{ID: "a2", Zone: "a"},
+		{ID: "a3", Zone: "a", NonVoter: true, Demoted: true},
+		{ID: "b1", Zone: "b"},
+		{ID: "c1", Zone: "c"},
+	}
+
+	voters, err := placeVoters(candidates, "a2")
+	if err != nil {
+		t.Fatalf("error placing voters: %v", err)
+	}
+
+	expected := map[string]bool{"a2": true, "b1": true, "c1": true}
+	if len(voters) != len(expected) {
+		t.Fatalf("expected voters %v, got: %v", expected, voters)
+	}
+	for id := range expected {
+		if !voters[id] {
+			t.Errorf("expected %s to vote", id)
+		}
+	}
+
+	if _, err := placeVoters(candidates[:4], "a1"); err == nil {
+		t.Error("expected an error with only two zones")
+	}
+
+	unzoned := append(candidates, &member{ID: "d1"})
+	if _, err := placeVoters(unzoned, "a1"); err == nil {
+		t.Error("expected an error for a member without a zone")
+	}
+}
+
+// voterCount returns the number of voters and non-voters in the leader's
+// configuration.
+func voterCount(t *testing.T, s *Server) (int, int) {
+	servers, err := s.servers()
+	if err != nil {
+		t.Fatalf("error reading configuration: %v", err)
+	}
+
+	voters, nonVoters := 0, 0
+	for _, srv := range servers {
+		if srv.Suffrage == raft.Voter {
+			voters++
+		} else {
+			nonVoters++
+		}
+	}
+
+	return voters, nonVoters
+}
+
+func TestPlacementRound(t *testing.T) {
+	zones := []string{"a", "a", "b", "c", "b"}
+	next := 0
+	zoned := func(c *Config) {
+		c.Zone = zones[next]
+		c.ZonePlacement = true
+		next++
+	}
+
+	servers := testCluster(t, 4, zoned)
+	leader, surplus := servers[0], servers[1]
+	ctx := testContext(t)
+
+	// Zone a holds two of four members, so one of them must stop voting for
+	// the loss of zone a to leave a quorum. The leader keeps its vote.
+	waitFor(t, "placement to demote a voter", func() bool {
+		voters, nonVoters := voterCount(t, leader)
+		m, ok := leader.fsm.Member(surplus.id)
+		return voters == 3 && nonVoters == 1 && ok && m.Demoted && m.NonVoter
+	})
+
+	if !surplus.isNonVoter() {
+		t.Error("the demoted member should know it no longer votes")
+	}
+
+	// A demoted member is still a raft peer and keeps receiving the log.
+	if _, err := leader.CreateBucket(ctx, "foo"); err != nil {
+		t.Fatalf("error creating bucket: %v", err)
+	}
+	token, err := leader.Set(ctx, "foo", "bar", "baz")
+	if err != nil {
+		t.Fatalf("error setting item: %v", err)
+	}
+
+	val, _, err := surplus.Get(ctx, "foo", "bar", &ReadOptions{Consistency: ConsistencyStale, Token: token})
+	if err != nil || val != "baz" {
+		t.Errorf("expected the demoted member to apply writes, got: '%v', %v", val, err)
+	}
+
+	// A second member in zone b lets two voters per zone survive the loss
+	// of any zone, so the demoted member votes again.
+	servers = append(servers, testServer(t, func(c *Config) {
+		c.RetryJoin = []string{leader.config.RPCAdvertise}
+		zoned(c)
+	}))
+	waitForMembers(t, servers...)
+
+	waitFor(t, "placement to promote the demoted member", func() bool {
+		voters, nonVoters := voterCount(t, leader)
+		m, ok := leader.fsm.Member(surplus.id)
+		return voters == 5 && nonVoters == 0 && ok && !m.Demoted && !m.NonVoter
+	})
+}
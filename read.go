@@ -0,0 +1,265 @@
+package blehdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// tokenWaitTimeout bounds how long a read waits for the local member to
+// apply the index in its ConsistencyToken.
+const tokenWaitTimeout = 5 * time.Second
+
+// ConsistencyToken is returned by every mutation and carries the raft index at
+// which it was committed. Passing it to a read guarantees the read observes
+// the mutation, whichever member serves it.
+type ConsistencyToken uint64
+
+func (t ConsistencyToken) String() string {
+	return strconv.FormatUint(uint64(t), 10)
+}
+
+// ParseConsistencyToken parses a token previously formatted with String.
+func ParseConsistencyToken(s string) (ConsistencyToken, error) {
+	i, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid consistency token '%s'", s)
+	}
+
+	return ConsistencyToken(i), nil
+}
+
+// ConsistencyMode selects the guarantees a read is made with.
+type ConsistencyMode uint8
+
+const (
+	// ConsistencyDefault reads from the leader, relying on its lease. A leader
+	// that was partitioned away can serve stale data until its lease expires.
+	ConsistencyDefault ConsistencyMode = iota
+
+	// ConsistencyStale reads from the local FSM on any member, without any
+	// guarantee about how current the data is.
+	ConsistencyStale
+
+	// ConsistencyLinearizable reads from the leader after confirming its
+	// leadership with a quorum and waiting until every entry committed before
+	// the read has been applied.
+	ConsistencyLinearizable
+)
+
+// ErrTooStale is returned by bounded-staleness reads that could not be served
+// locally within ReadOptions.MaxStaleness and were not allowed to be
+// forwarded to the leader.
+var ErrTooStale = errors.New("local data is too stale")
+
+// ReadOptions controls how a read is served. A nil *ReadOptions is the same
+// as the zero value, which uses ConsistencyDefault.
+type ReadOptions struct {
+	Consistency ConsistencyMode
+
+	// MaxStaleness bounds how stale a ConsistencyStale read served by a
+	// follower may be. The follower must have heard from the leader within
+	// MaxStaleness and have applied everything it knows to be committed.
+	// Reads that cannot meet the bound are forwarded to the leader. Zero
+	// means unbounded.
+	MaxStaleness time.Duration
+
+	// FailIfStale makes reads that cannot meet MaxStaleness fail with
+	// ErrTooStale instead of being forwarded to the leader.
+	FailIfStale bool
+
+	// Token makes the read wait, for up to five seconds or until the context
+	// is done, until the serving member has applied the mutation the token
+	// was returned from.
+	Token ConsistencyToken
+}
+
+// ReadMeta describes how a read was served.
+type ReadMeta struct {
+	// Staleness is the time since the member that served the read last
+	// heard from the leader. It is zero for reads served by the leader.
+	Staleness time.Duration
+
+	// KnownLeader reports whether the serving member knew of a leader.
+	KnownLeader bool
+
+	// Index is the raft index applied by the serving member at read time.
+	Index uint64
+}
+
+func (s *Server) Get(ctx context.Context, bucket, key string, opts *ReadOptions) (string, *ReadMeta, error) {
+	if opts == nil {
+		opts = &ReadOptions{}
+	}
+
+	if s.isShutdown() {
+		return "", nil, ErrShutdown
+	}
+
+	if opts.Consistency == ConsistencyStale {
+		if s.raft.State() == raft.Leader || opts.MaxStaleness == 0 || s.withinStaleness(ctx, opts.MaxStaleness) {
+			if err := s.waitForToken(ctx, opts.Token); err != nil {
+				return "", nil, err
+			}
+			return s.localGet(bucket, key)
+		}
+
+		if opts.FailIfStale {
+			return "", nil, ErrTooStale
+		}
+
+		opts = &ReadOptions{
+			Consistency: ConsistencyDefault,
+			Token:       opts.Token,
+		}
+	}
+
+	var val string
+	var meta *ReadMeta
+	err := s.retryLeader(ctx, func() error {
+		if s.raft.State() == raft.Leader {
+			var err error
+			val, meta, err = s.consistentGet(ctx, bucket, key, opts)
+			return err
+		}
+
+		args := &ReadRequest{
+			Bucket:  bucket,
+			Key:     key,
+			Options: *opts,
+		}
+
+		var resp ReadResponse
+		if err := s.forwardToLeader(ctx, "Management.Read", args, &resp); err != nil {
+			return err
+		}
+
+		val, meta = resp.Value, &resp.Meta
+		return nil
+	})
+
+	return val, meta, err
+}
+
+// localGet reads from the local FSM without any consistency checks.
+func (s *Server) localGet(bucket, key string) (string, *ReadMeta, error) {
+	meta := &ReadMeta{
+		KnownLeader: s.leaderAddr() != "",
+		Index:       s.fsm.AppliedIndex(),
+	}
+
+	if s.raft.State() != raft.Leader {
+		meta.Staleness = time.Since(s.lastContact())
+	}
+
+	val, err := s.fsm.Store().GetItem(bucket, key)
+	return val, meta, err
+}
+
+// consistentGet serves a non-stale read on the leader.
+func (s *Server) consistentGet(ctx context.Context, bucket, key string, opts *ReadOptions) (string, *ReadMeta, error) {
+	// A newly elected leader may not have applied everything yet.
+	if err := s.waitForToken(ctx, opts.Token); err != nil {
+		return "", nil, err
+	}
+
+	if opts.Consistency == ConsistencyLinearizable {
+		if err := s.readIndex(ctx); err != nil {
+			return "", nil, err
+		}
+	}
+
+	return s.localGet(bucket, key)
+}
+
+// withinStaleness reports whether a follower or replica can serve a read within max
+// staleness. If the follower has not yet applied everything it knows to be
+// committed, it waits for the FSM to catch up for as long as the bound allows.
+func (s *Server) withinStaleness(ctx context.Context, max time.Duration) bool {
+	last := s.lastContact()
+	if last.IsZero() {
+		return false
+	}
+
+	deadline := last.Add(max)
+	if time.Now().After(deadline) {
+		return false
+	}
+
+	commit, err := s.knownCommitIndex()
+	if err != nil {
+		return false
+	}
+
+	commit = s.fsmIndex(commit)
+
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	return s.WaitForIndex(ctx, commit) == nil
+}
+
+// readIndex implements a read-index barrier. Everything committed before the
+// read is at or below the current last index; once leadership is confirmed
+// and the FSM has applied up to that index, a local read is linearizable.
+func (s *Server) readIndex(ctx context.Context) error {
+	index := s.fsmIndex(s.raft.LastIndex())
+
+	if err := s.raft.VerifyLeader().Error(); err != nil {
+		return err
+	}
+
+	return s.WaitForIndex(ctx, index)
+}
+
+// fsmIndex returns the index of the last entry at or before index that the
+// FSM records, for waiting on with WaitForIndex. Entries such as the noop a
+// new leader appends never reach the FSM, so waiting on their index would
+// stall until the next write. Zero is returned if the entries have been
+// compacted away, as the FSM has applied every entry in a snapshot.
+func (s *Server) fsmIndex(index uint64) uint64 {
+	for ; index > 0; index-- {
+		var l raft.Log
+		if err := s.raftStore.GetLog(index, &l); err != nil {
+			return 0
+		}
+
+		switch l.Type {
+		case raft.LogCommand, raft.LogConfiguration:
+			return index
+		}
+	}
+
+	return 0
+}
+
+func (s *Server) waitForToken(ctx context.Context, token ConsistencyToken) error {
+	if token == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, tokenWaitTimeout)
+	defer cancel()
+
+	return s.WaitForIndex(ctx, uint64(token))
+}
+
+// WaitForIndex blocks until the local member has applied the raft log entry
+// at index, or ctx is done.
+func (s *Server) WaitForIndex(ctx context.Context, index uint64) error {
+	ch, cancel := s.fsm.IndexCh(index)
+	defer cancel()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.shutdownCh:
+		return ErrShutdown
+	}
+}
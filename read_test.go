@@ -0,0 +1,157 @@
+package blehdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestParseConsistencyToken(t *testing.T) {
+	token := ConsistencyToken(42)
+
+	parsed, err := ParseConsistencyToken(token.String())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if parsed != token {
+		t.Errorf("expected token %v, got: %v", token, parsed)
+	}
+
+	if _, err := ParseConsistencyToken("nope"); err == nil {
+		t.Error("invalid tokens should return an error")
+	}
+}
+
+func TestLinearizableReadAfterElection(t *testing.T) {
+	config := testConfig(t)
+	config.Bootstrap = true
+
+	s := startServer(t, config)
+	waitForLeader(t, s)
+	waitForMembers(t, s)
+	ctx := testContext(t)
+
+	if _, err := s.CreateBucket(ctx, "foo"); err != nil {
+		t.Fatalf("error creating bucket: %v", err)
+	}
+	if _, err := s.Set(ctx, "foo", "bar", "baz"); err != nil {
+		t.Fatalf("error setting item: %v", err)
+	}
+	s.Close()
+
+	s = startServer(t, config)
+	waitForLeader(t, s)
+
+	// The new term starts with a noop that the FSM never sees, and nothing
+	// has been written since.
+	var l raft.Log
+	if err := s.raftStore.GetLog(s.raft.LastIndex(), &l); err != nil || l.Type != raft.LogNoop {
+		t.Fatalf("expected the last entry to be a noop, got: %v, %v", l.Type, err)
+	}
+
+	readCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	val, _, err := s.Get(readCtx, "foo", "bar", &ReadOptions{Consistency: ConsistencyLinearizable})
+	if err != nil || val != "baz" {
+		t.Errorf("expected a linearizable read straight after the election, got: '%v', %v", val, err)
+	}
+}
+
+func TestReadConsistencyModes(t *testing.T) {
+	servers := testCluster(t, 2, nil)
+	leader, follower := servers[0], servers[1]
+	ctx := testContext(t)
+
+	if _, err := leader.CreateBucket(ctx, "foo"); err != nil {
+		t.Fatalf("error creating bucket: %v", err)
+	}
+	token, err := leader.Set(ctx, "foo", "bar", "baz")
+	if err != nil {
+		t.Fatalf("error setting item: %v", err)
+	}
+
+	modes := []struct {
+		name string
+		opts *ReadOptions
+	}{
+		{"default", nil},
+		{"stale", &ReadOptions{Consistency: ConsistencyStale, Token: token}},
+		{"linearizable", &ReadOptions{Consistency: ConsistencyLinearizable}},
+	}
+
+	for _, mode := range modes {
+		for _, s := range servers {
+			val, meta, err := s.Get(ctx, "foo", "bar", mode.opts)
+			if err != nil || val != "baz" {
+				t.Errorf("%s read on %s: expected 'baz', got: '%v', %v", mode.name, s.id, val, err)
+				continue
+			}
+
+			if meta.Index < uint64(token) {
+				t.Errorf("%s read on %s: expected index %d or later, got: %d", mode.name, s.id, token, meta.Index)
+			}
+
+			// Only stale reads are served by the follower itself; the rest
+			// are forwarded to the leader.
+			local := s == follower && mode.opts != nil && mode.opts.Consistency == ConsistencyStale
+			if local != (meta.Staleness > 0) {
+				t.Errorf("%s read on %s: unexpected staleness %v", mode.name, s.id, meta.Staleness)
+			}
+		}
+	}
+
+	if _, _, err := follower.Get(ctx, "foo", "dne", &ReadOptions{Consistency: ConsistencyLinearizable}); err == nil {
+		t.Error("reading a missing key should return an error")
+	}
+}
+
+func TestBoundedStalenessRead(t *testing.T) {
+	servers := testCluster(t, 2, nil)
+	leader, follower := servers[0], servers[1]
+	ctx := testContext(t)
+
+	if _, err := leader.CreateBucket(ctx, "foo"); err != nil {
+		t.Fatalf("error creating bucket: %v", err)
+	}
+	if _, err := leader.Set(ctx, "foo", "bar", "baz"); err != nil {
+		t.Fatalf("error setting item: %v", err)
+	}
+
+	// A follower in contact with the leader serves the read itself.
+	opts := &ReadOptions{Consistency: ConsistencyStale, MaxStaleness: time.Minute, FailIfStale: true}
+	waitFor(t, "the follower to apply the write", func() bool {
+		val, meta, err := follower.Get(ctx, "foo", "bar", opts)
+		return err == nil && val == "baz" && meta.Staleness > 0
+	})
+
+	// A bound the follower cannot meet is forwarded to the leader, unless
+	// the read must fail instead.
+	opts = &ReadOptions{Consistency: ConsistencyStale, MaxStaleness: time.Nanosecond}
+	val, meta, err := follower.Get(ctx, "foo", "bar", opts)
+	if err != nil || val != "baz" || meta.Staleness != 0 {
+		t.Errorf("expected the read to be forwarded to the leader, got: '%v', %+v, %v", val, meta, err)
+	}
+
+	opts.FailIfStale = true
+	if _, _, err := follower.Get(ctx, "foo", "bar", opts); err != ErrTooStale {
+		t.Errorf("expected ErrTooStale, got: %v", err)
+	}
+
+	// Without a leader the follower's data ages past the bound.
+	leader.Close()
+	time.Sleep(time.Second)
+
+	opts = &ReadOptions{Consistency: ConsistencyStale, MaxStaleness: 500 * time.Millisecond, FailIfStale: true}
+	if _, _, err := follower.Get(ctx, "foo", "bar", opts); err != ErrTooStale {
+		t.Errorf("expected ErrTooStale once the leader is gone, got: %v", err)
+	}
+
+	val, _, err = follower.Get(ctx, "foo", "bar", &ReadOptions{Consistency: ConsistencyStale})
+	if err != nil || val != "baz" {
+		t.Errorf("expected an unbounded read to be served, got: '%v', %v", val, err)
+	}
+}
@@ -0,0 +1,130 @@
+package blehdb
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+const (
+	// replicaPollInterval is how often a replica waiting to be promoted
+	// checks whether it has caught up.
+	replicaPollInterval = 100 * time.Millisecond
+
+	// replicaPromoteMaxLag is how many entries a replica may trail the commit
+	// index by and still be considered caught up for promotion.
+	replicaPromoteMaxLag = 16
+)
+
+// isNonVoter reports whether the local member takes no part in elections or
+// quorum. Until it has joined raft, that is what Config.NonVoter asks for.
+func (s *Server) isNonVoter() bool {
+	if servers, err := s.servers(); err == nil && hasServer(servers, s.id) {
+		return !isVoter(servers, s.id)
+	}
+
+	return s.config.NonVoter
+}
+
+// leaderAddr returns the raft address of the current leader, if known.
+func (s *Server) leaderAddr() string {
+	return string(s.raft.Leader())
+}
+
+// leaderRPCAddr returns the RPC address of the current leader, if known.
+func (s *Server) leaderRPCAddr() (string, bool) {
+	leader := string(s.raft.Leader())
+	if leader == "" {
+		return "", false
+	}
+
+	m, ok := s.fsm.MemberByAddr(leader)
+	if !ok {
+		return "", false
+	}
+
+	return m.RPCAddr, true
+}
+
+// lastContact returns when the local member last heard from the leader.
+func (s *Server) lastContact() time.Time {
+	return s.raft.LastContact()
+}
+
+// knownCommitIndex returns the highest index the local member knows to be
+// committed.
+func (s *Server) knownCommitIndex() (uint64, error) {
+	return strconv.ParseUint(s.raft.Stats()["commit_index"], 10, 64)
+}
+
+// isDemoted reports whether zone placement demoted the local member, in which
+// case only placement may promote it again.
+func (s *Server) isDemoted() bool {
+	m, ok := s.fsm.Member(s.id)
+	return ok && m.Demoted
+}
+
+// runPromotion waits for a replica started with Config.PromoteNonVoter to
+// join raft as a non-voter and catch up with the log, and then asks the
+// leader to make it a voter. Raft has been sending it the log all along, so
+// only its suffrage changes.
+func (s *Server) runPromotion() {
+	ticker := time.NewTicker(replicaPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.shutdownCh:
+			return
+		}
+
+		servers, err := s.servers()
+		if err != nil || !hasServer(servers, s.id) {
+			continue
+		}
+
+		if isVoter(servers, s.id) {
+			return
+		}
+
+		if s.isDemoted() || !s.replicaCaughtUp() {
+			continue
+		}
+
+		if err := s.promote(); err != nil {
+			s.logger.Printf("error promoting replica to voter: %v", err)
+		}
+	}
+}
+
+func (s *Server) replicaCaughtUp() bool {
+	if s.raft.Leader() == "" {
+		return false
+	}
+
+	commit, err := s.knownCommitIndex()
+	if err != nil {
+		return false
+	}
+
+	return commit <= s.fsm.AppliedIndex()+replicaPromoteMaxLag
+}
+
+// promote asks the leader to make the local replica a voter.
+func (s *Server) promote() error {
+	s.logger.Println("Replica has caught up, promoting to voter")
+
+	ctx, cancel := context.WithTimeout(context.Background(), raftApplyTimeout)
+	defer cancel()
+
+	args := &JoinRequest{
+		ID:         s.id,
+		Address:    s.config.RaftAdvertise,
+		RPCAddress: s.config.RPCAdvertise,
+		Zone:       s.config.Zone,
+	}
+
+	var resp JoinResponse
+	return s.forwardToLeader(ctx, "Management.Join", args, &resp)
+}
@@ -0,0 +1,102 @@
+package blehdb
+
+import (
+	"testing"
+)
+
+func TestNonVoterReplica(t *testing.T) {
+	servers := testCluster(t, 1, nil)
+	leader := servers[0]
+	ctx := testContext(t)
+
+	if _, err := leader.CreateBucket(ctx, "foo"); err != nil {
+		t.Fatalf("error creating bucket: %v", err)
+	}
+
+	replica := testServer(t, func(c *Config) {
+		c.RetryJoin = []string{leader.config.RPCAdvertise}
+		c.NonVoter = true
+	})
+	waitForMembers(t, leader, replica)
+
+	voters, nonVoters := voterCount(t, leader)
+	m, ok := leader.fsm.Member(replica.id)
+	if voters != 1 || nonVoters != 1 || !ok || !m.NonVoter {
+		t.Fatalf("expected the replica to be a raft non-voter, got: %d voters, %d non-voters, %+v", voters, nonVoters, m)
+	}
+
+	if !replica.isNonVoter() {
+		t.Error("the replica should know it does not vote")
+	}
+
+	// The replica receives the log, including what was written before it
+	// joined, through raft.
+	token, err := leader.Set(ctx, "foo", "bar", "baz")
+	if err != nil {
+		t.Fatalf("error setting item: %v", err)
+	}
+
+	val, _, err := replica.Get(ctx, "foo", "bar", &ReadOptions{Consistency: ConsistencyStale, Token: token})
+	if err != nil || val != "baz" {
+		t.Errorf("expected the replica to apply writes, got: '%v', %v", val, err)
+	}
+
+	// Joining again, as a restarted replica does, changes nothing.
+	if err := replica.Join(leader.config.RPCAdvertise); err != nil {
+		t.Fatalf("error joining again: %v", err)
+	}
+	if voters, nonVoters := voterCount(t, leader); voters != 1 || nonVoters != 1 {
+		t.Errorf("expected joining again to keep the replica a non-voter, got: %d voters, %d non-voters", voters, nonVoters)
+	}
+
+	if err := replica.Leave(ctx); err != nil {
+		t.Fatalf("error leaving: %v", err)
+	}
+
+	peers, err := leader.servers()
+	if err != nil || hasServer(peers, replica.id) {
+		t.Errorf("expected the replica to have left raft, got: %v, %v", peers, err)
+	}
+	if _, ok := leader.fsm.Member(replica.id); ok {
+		t.Error("expected the replica to have been deregistered")
+	}
+}
+
+func TestPromoteNonVoter(t *testing.T) {
+	servers := testCluster(t, 1, nil)
+	leader := servers[0]
+	ctx := testContext(t)
+
+	if _, err := leader.CreateBucket(ctx, "foo"); err != nil {
+		t.Fatalf("error creating bucket: %v", err)
+	}
+	if _, err := leader.Set(ctx, "foo", "bar", "baz"); err != nil {
+		t.Fatalf("error setting item: %v", err)
+	}
+
+	replica := testServer(t, func(c *Config) {
+		c.RetryJoin = []string{leader.config.RPCAdvertise}
+		c.NonVoter = true
+		c.PromoteNonVoter = true
+	})
+
+	waitFor(t, "the replica to be promoted", func() bool {
+		voters, nonVoters := voterCount(t, leader)
+		m, ok := leader.fsm.Member(replica.id)
+		return voters == 2 && nonVoters == 0 && ok && !m.NonVoter
+	})
+
+	// Promotion only changes suffrage, so every entry is applied exactly once.
+	val, _, err := replica.Get(ctx, "foo", "bar", &ReadOptions{Consistency: ConsistencyStale})
+	if err != nil || val != "baz" {
+		t.Errorf("expected the promoted replica to keep its data, got: '%v', %v", val, err)
+	}
+
+	// A promoted replica keeps its vote when it joins again as a non-voter.
+	if err := replica.Join(leader.config.RPCAdvertise); err != nil {
+		t.Fatalf("error joining again: %v", err)
+	}
+	if voters, nonVoters := voterCount(t, leader); voters != 2 || nonVoters != 0 {
+		t.Errorf("expected the promoted replica to keep its vote, got: %d voters, %d non-voters", voters, nonVoters)
+	}
+}
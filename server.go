@@ -1,30 +1,69 @@
 package blehdb
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/rpc"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
+	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/raft"
 	raftboltdb "github.com/hashicorp/raft-boltdb"
 )
 
+const (
+	// raftApplyTimeout bounds how long an apply may wait to be enqueued when
+	// the caller's context has no deadline.
+	raftApplyTimeout = 10 * time.Second
+
+	// retryJoinMinWait and retryJoinMaxWait bound the backoff between rounds
+	// of join attempts against Config.RetryJoin and discovered addresses.
+	retryJoinMinWait = time.Second
+	retryJoinMaxWait = 30 * time.Second
+)
+
+// ErrShutdown is returned by operations on a Server that has been shut down.
+var ErrShutdown = errors.New("server is shut down")
+
 type Server struct {
 	config    *Config
 	logger    *log.Logger
 	fsm       *blehFSM
 	raft      *raft.Raft
 	raftStore *raftboltdb.BoltStore
-	peerStore *raft.JSONPeers
+	transport *raft.NetworkTransport
+
+	// raftLayer carries raft over the RPC listener with Config.SinglePort.
+	raftLayer *raftLayer
+
+	// id is the persistent server ID raft knows this member by.
+	id string
 
 	rpcListener net.Listener
 	rpcServer   *rpc.Server
+	rpcConns    map[net.Conn]struct{}
+	rpcLock     sync.Mutex
 
 	manager *Management
+	events  *eventBroker
+	expect  *expectBootstrap
+
+	autopilot *autopilotState
+	gossip    *gossip
+
+	// writeLock is held for reading while applying to raft, and for writing
+	// while a leadership transfer pauses writes.
+	writeLock sync.RWMutex
+
+	shutdown     bool
+	shutdownCh   chan struct{}
+	shutdownLock sync.Mutex
 }
 
 func NewServer(config *Config) (*Server, error) {
@@ -32,24 +71,160 @@ func NewServer(config *Config) (*Server, error) {
 		return nil, fmt.Errorf("Invalid Config: %v", err)
 	}
 
+	// Work on a copy so that derived advertise addresses don't leak into the
+	// caller's config.
+	c := *config
+	config = &c
+
+	var err error
+	if config.RPCAdvertise, err = advertiseAddr(config.RPCBind, config.RPCAdvertise); err != nil {
+		return nil, fmt.Errorf("Invalid Config: %v", err)
+	}
+	if config.SinglePort {
+		config.RaftAdvertise = config.RPCAdvertise
+	} else if config.RaftAdvertise, err = advertiseAddr(config.RaftBind, config.RaftAdvertise); err != nil {
+		return nil, fmt.Errorf("Invalid Config: %v", err)
+	}
+
 	s := &Server{
-		config:    config,
-		logger:    log.New(os.Stdout, "[BLEHDB] ", log.LstdFlags),
-		rpcServer: rpc.NewServer(),
+		config:     config,
+		logger:     log.New(os.Stdout, "[BLEHDB] ", log.LstdFlags),
+		rpcServer:  rpc.NewServer(),
+		rpcConns:   make(map[net.Conn]struct{}),
+		events:     newEventBroker(),
+		autopilot:  &autopilotState{},
+		shutdownCh: make(chan struct{}),
 	}
 
 	if err := s.setupRaft(); err != nil {
-		// TODO: shutdown cleanly
+		s.Close()
 		return nil, fmt.Errorf("Failed to start Raft: %v", err)
 	}
 
 	if err := s.setupRPC(); err != nil {
+		s.Close()
 		return nil, fmt.Errorf("Failed to start RPC: %v", err)
 	}
 
+	if config.GossipBind != "" {
+		if err := s.setupGossip(); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("Failed to start gossip: %v", err)
+		}
+	}
+
+	if config.Zone != "" || config.GossipBind != "" {
+		go s.watchRole()
+	}
+
+	if len(config.RetryJoin) > 0 || config.Discoverer != nil {
+		go s.retryJoin()
+	}
+
+	if config.NonVoter && config.PromoteNonVoter {
+		go s.runPromotion()
+	}
+
 	return s, nil
 }
 
+// Shutdown stops the server. If Config.LeaveOnShutdown is set, the member
+// first leaves the cluster. The RPC server is then stopped, raft is shut down
+// and its stores are closed. Operations still in flight fail with
+// ErrShutdown. Shutdown gives up waiting for raft when ctx is done, but still
+// closes the transport, stores and archive before returning ctx's error.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.shutdownServer(ctx, s.config.LeaveOnShutdown)
+}
+
+// Close stops the server immediately, without leaving the cluster.
+func (s *Server) Close() error {
+	return s.shutdownServer(context.Background(), false)
+}
+
+func (s *Server) shutdownServer(ctx context.Context, leave bool) error {
+	s.shutdownLock.Lock()
+	defer s.shutdownLock.Unlock()
+
+	if s.shutdown {
+		return nil
+	}
+	s.shutdown = true
+	s.logger.Println("Shutting down")
+
+	if leave && s.raft != nil {
+		if err := s.Leave(ctx); err != nil {
+			s.logger.Printf("error leaving the cluster: %v", err)
+		}
+	}
+
+	close(s.shutdownCh)
+
+	if s.rpcListener != nil {
+		s.rpcListener.Close()
+	}
+
+	s.rpcLock.Lock()
+	for conn := range s.rpcConns {
+		conn.Close()
+	}
+	s.rpcLock.Unlock()
+
+	if s.gossip != nil {
+		s.gossip.leave(leave)
+	}
+
+	// The rest of the teardown runs even if raft fails to stop in time, so
+	// that its listener, files and archive are released either way.
+	var shutdownErr error
+	if s.raft != nil {
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- s.raft.Shutdown().Error()
+		}()
+
+		select {
+		case err := <-errCh:
+			if err != nil {
+				shutdownErr = fmt.Errorf("shutting down raft: %v", err)
+			}
+		case <-ctx.Done():
+			shutdownErr = fmt.Errorf("shutting down raft: %v", ctx.Err())
+		}
+	}
+
+	if s.transport != nil {
+		if err := s.transport.Close(); err != nil {
+			s.logger.Printf("error closing raft transport: %v", err)
+		}
+	}
+
+	if s.raftStore != nil {
+		if err := s.raftStore.Close(); err != nil {
+			s.logger.Printf("error closing raft store: %v", err)
+		}
+	}
+
+	if s.fsm != nil && s.fsm.archiver != nil {
+		if err := s.fsm.archiver.Close(); err != nil {
+			s.logger.Printf("error closing log archiver: %v", err)
+		}
+	}
+
+	s.events.close()
+
+	return shutdownErr
+}
+
+func (s *Server) isShutdown() bool {
+	select {
+	case <-s.shutdownCh:
+		return true
+	default:
+		return false
+	}
+}
+
 func (s *Server) setupRPC() error {
 	s.manager = &Management{s}
 	s.rpcServer.Register(s.manager)
@@ -66,33 +241,117 @@ func (s *Server) setupRPC() error {
 }
 
 func (s *Server) listen() {
-	s.rpcServer.Accept(s.rpcListener)
-	s.logger.Println("RPC.Accept has returned. This might be an error.")
+	for {
+		conn, err := s.rpcListener.Accept()
+		if err != nil {
+			if s.isShutdown() {
+				return
+			}
+			s.logger.Printf("error accepting RPC connection: %v", err)
+			continue
+		}
+
+		if s.config.SinglePort {
+			go s.handleMux(conn)
+			continue
+		}
+
+		s.trackConn(conn)
+		go s.serveConn(conn)
+	}
 }
 
-func (s *Server) Join(addr string) error {
-	client, err := rpc.Dial("tcp", addr)
+// trackConn records a connection accepted by the RPC listener so that it is
+// closed on shutdown.
+func (s *Server) trackConn(conn net.Conn) {
+	s.rpcLock.Lock()
+	s.rpcConns[conn] = struct{}{}
+	s.rpcLock.Unlock()
+}
+
+// untrackConn forgets a connection once it has been closed.
+func (s *Server) untrackConn(conn net.Conn) {
+	s.rpcLock.Lock()
+	delete(s.rpcConns, conn)
+	s.rpcLock.Unlock()
+}
 
+func (s *Server) serveConn(conn net.Conn) {
+	s.rpcServer.ServeConn(conn)
+	s.untrackConn(conn)
+}
+
+// retryJoin tries each seed address in turn until one accepts the join,
+// backing off between rounds, so that members can be started in any order.
+// Seeds are discovered again at the start of every round.
+func (s *Server) retryJoin() {
+	wait := retryJoinMinWait
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), raftApplyTimeout)
+		seeds := s.joinAddrs(ctx)
+		cancel()
+
+		for _, addr := range seeds {
+			if addr == s.config.RPCAdvertise || addr == s.config.RPCBind {
+				continue
+			}
+
+			err := s.Join(addr)
+			if err == nil {
+				s.logger.Printf("Joined the cluster through %s", addr)
+				return
+			}
+			s.logger.Printf("error joining %s: %v", addr, err)
+		}
+
+		s.logger.Printf("Unable to join any seed, retrying in %v", wait)
+		select {
+		case <-time.After(wait):
+		case <-s.shutdownCh:
+			return
+		}
+
+		wait *= 2
+		if wait > retryJoinMaxWait {
+			wait = retryJoinMaxWait
+		}
+	}
+}
+
+func (s *Server) Join(addr string) error {
+	conn, err := s.dialRPC(addr, rpcDialTimeout)
 	if err != nil {
 		return err
 	}
 
+	client := rpc.NewClient(conn)
+	defer client.Close()
+
 	args := &JoinRequest{
-		Address: s.config.RaftBind,
+		ID:         s.id,
+		Address:    s.config.RaftAdvertise,
+		RPCAddress: s.config.RPCAdvertise,
+		Zone:       s.config.Zone,
+		NonVoter:   s.config.NonVoter,
 	}
 
-	var resp string
+	var resp JoinResponse
 
 	err = client.Call("Management.Join", args, &resp)
 	if err != nil {
 		return err
 	}
 
-	s.logger.Printf("Raft join returned: %v", resp)
+	s.logger.Printf("Joined cluster with leader '%s' and peers %v", resp.Leader, resp.Peers)
 
 	return nil
 }
 
+// raftLogger adapts logger to the hclog interface raft logs through.
+func raftLogger(logger *log.Logger) hclog.Logger {
+	return hclog.FromStandardLogger(logger, &hclog.LoggerOptions{Level: hclog.Info})
+}
+
 func (s *Server) setupRaft() error {
 	var err error
 
@@ -100,30 +359,75 @@ func (s *Server) setupRaft() error {
 	if err != nil {
 		return err
 	}
+	s.fsm.notify = s.publish
 
-	config := raft.DefaultConfig()
-	config.Logger = s.logger
+	if s.config.KeyProvider != nil {
+		s.fsm.keyring, err = newKeyring(s.config.KeyProvider)
+		if err != nil {
+			return fmt.Errorf("loading encryption keys: %v", err)
+		}
+	}
 
-	bootstrap := true
-	if bootstrap {
-		s.logger.Println("Entering bootstrap mode")
-		config.EnableSingleNode = true
-		config.DisableBootstrapAfterElect = false
+	if s.config.ArchiveDir != "" {
+		s.fsm.archiver, err = newLogArchiver(s.config.ArchiveDir, s.fsm.logger)
+		if err != nil {
+			return fmt.Errorf("new log archiver: %v", err)
+		}
 	}
 
-	addr, err := net.ResolveTCPAddr("tcp", s.config.RaftBind)
+	s.id, err = loadNodeID(s.config.StorageDir, s.config.RaftAdvertise)
 	if err != nil {
-		return err
+		return fmt.Errorf("loading server ID: %v", err)
 	}
 
-	transport, err := raft.NewTCPTransportWithLogger(s.config.RaftBind, addr, 3, 10*time.Second, s.logger)
+	config := raft.DefaultConfig()
+	config.Logger = raftLogger(s.logger)
+	config.LocalID = raft.ServerID(s.id)
+
+	if s.config.SnapshotInterval != 0 {
+		config.SnapshotInterval = s.config.SnapshotInterval
+	}
+	if s.config.SnapshotThreshold != 0 {
+		config.SnapshotThreshold = s.config.SnapshotThreshold
+	}
+	if s.config.TrailingLogs != 0 {
+		config.TrailingLogs = s.config.TrailingLogs
+	}
+
+	// A member with existing state already belongs to a cluster and must
+	// never bootstrap a new one, regardless of its configuration.
+	bootstrap := false
+	if hasExistingState(s.config.StorageDir) {
+		s.logger.Println("Found existing raft state, skipping bootstrap")
+	} else if s.config.Bootstrap {
+		s.logger.Println("Entering bootstrap mode")
+		bootstrap = true
+	} else if s.config.BootstrapExpect > 0 {
+		s.logger.Printf("Waiting for %d peers before bootstrapping", s.config.BootstrapExpect)
+		s.expect = newExpectBootstrap(s.config.BootstrapExpect, &JoinRequest{
+			ID:         s.id,
+			Address:    s.config.RaftAdvertise,
+			RPCAddress: s.config.RPCAdvertise,
+			Zone:       s.config.Zone,
+		})
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", s.config.RaftAdvertise)
 	if err != nil {
 		return err
 	}
 
-	s.peerStore = raft.NewJSONPeers(s.config.StorageDir, transport)
+	if s.config.SinglePort {
+		s.raftLayer = newRaftLayer(addr)
+		s.transport = raft.NewNetworkTransportWithLogger(s.raftLayer, 3, 10*time.Second, raftLogger(s.logger))
+	} else {
+		s.transport, err = raft.NewTCPTransportWithLogger(s.config.RaftBind, addr, 3, 10*time.Second, raftLogger(s.logger))
+		if err != nil {
+			return err
+		}
+	}
 
-	snapshots, err := raft.NewFileSnapshotStoreWithLogger(s.config.StorageDir, 2, s.logger)
+	snapshots, err := raft.NewFileSnapshotStoreWithLogger(s.config.StorageDir, s.config.snapshotRetain(), raftLogger(s.logger))
 	if err != nil {
 		return err
 	}
@@ -133,19 +437,45 @@ func (s *Server) setupRaft() error {
 		return fmt.Errorf("new BoltStore: %v", err)
 	}
 
-	s.raft, err = raft.NewRaft(config, s.fsm, s.raftStore, s.raftStore, snapshots, s.peerStore, transport)
+	if err := s.migratePeers(config, snapshots); err != nil {
+		return err
+	}
+
+	s.raft, err = raft.NewRaft(config, s.fsm, s.raftStore, s.raftStore, snapshots, s.transport)
 	if err != nil {
 		return fmt.Errorf("new Raft: %v", err)
 	}
 
-	return nil
-}
+	if err := s.checkSinglePort(); err != nil {
+		return err
+	}
+
+	// Snapshots written before the FSM recorded its index restore at index
+	// zero; take the index from the snapshot raft restored instead.
+	if snaps, err := snapshots.List(); err == nil && len(snaps) > 0 && s.fsm.AppliedIndex() < snaps[0].Index {
+		s.fsm.setIndex(snaps[0].Index)
+	}
 
-func (s *Server) Set(bucket, key, value string) error {
-	if s.raft.State() != raft.Leader {
-		return fmt.Errorf("this member is not the leader, cannot mutate values")
+	if bootstrap {
+		err := s.raft.BootstrapCluster(raft.Configuration{
+			Servers: []raft.Server{{
+				Suffrage: raft.Voter,
+				ID:       config.LocalID,
+				Address:  s.transport.LocalAddr(),
+			}},
+		}).Error()
+		if err != nil {
+			return fmt.Errorf("bootstrapping cluster: %v", err)
+		}
 	}
 
+	go s.monitorLeadership()
+	go s.observeLeader()
+
+	return nil
+}
+
+func (s *Server) Set(ctx context.Context, bucket, key, value string) (ConsistencyToken, error) {
 	c := &command{
 		Bucket: bucket,
 		Key:    key,
@@ -154,15 +484,10 @@ func (s *Server) Set(bucket, key, value string) error {
 
 	b, err := encodeMessage(SetItemRequestType, c)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	return s.applyRaft(b)
-}
-
-func (s *Server) Get(bucket, key string) (string, error) {
-	val, err := s.fsm.Store().GetItem(bucket, key)
-	return val, err
+	return s.apply(ctx, b)
 }
 
 func (s *Server) BucketExists(bucket string) bool {
@@ -173,7 +498,7 @@ func (s *Server) ListBuckets() []string {
 	return s.fsm.Store().ListBuckets()
 }
 
-func (s *Server) Delete(bucket, key string) error {
+func (s *Server) Delete(ctx context.Context, bucket, key string) (ConsistencyToken, error) {
 	c := &command{
 		Bucket: bucket,
 		Key:    key,
@@ -181,55 +506,83 @@ func (s *Server) Delete(bucket, key string) error {
 
 	b, err := encodeMessage(DeleteItemRequestType, c)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	return s.applyRaft(b)
+	return s.apply(ctx, b)
 }
 
-func (s *Server) CreateBucket(name string) error {
-	if s.raft.State() != raft.Leader {
-		return fmt.Errorf("this member is not the leader, cannot mutate values")
-	}
-
+func (s *Server) CreateBucket(ctx context.Context, name string) (ConsistencyToken, error) {
 	c := &command{
 		Bucket: name,
 	}
 
 	b, err := encodeMessage(CreateBucketRequestType, c)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	return s.applyRaft(b)
+	return s.apply(ctx, b)
 }
 
-func (s *Server) DeleteBucket(name string) error {
-	if s.raft.State() != raft.Leader {
-		return fmt.Errorf("this member is not the leader, cannot mutate values")
-	}
-
+func (s *Server) DeleteBucket(ctx context.Context, name string) (ConsistencyToken, error) {
 	c := &command{
 		Bucket: name,
 	}
 
 	b, err := encodeMessage(DeleteBucketRequestType, c)
 	if err != nil {
-		return err
+		return 0, err
+	}
+
+	return s.apply(ctx, b)
+}
+
+// Snapshot forces the local raft instance to take a snapshot and compact its
+// log, which is useful before planned maintenance.
+func (s *Server) Snapshot() error {
+	err := s.raft.Snapshot().Error()
+	if err == raft.ErrRaftShutdown {
+		return ErrShutdown
 	}
 
-	return s.applyRaft(b)
+	return err
 }
 
-func (s *Server) applyRaft(msg []byte) error {
-	f := s.raft.Apply(msg, 10*time.Second)
+// applyRaft applies a message through the local raft instance, which must be
+// the leader, and returns a token for the index it was committed at.
+func (s *Server) applyRaft(ctx context.Context, msg []byte) (ConsistencyToken, error) {
+	timeout := raftApplyTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = deadline.Sub(time.Now())
+		if timeout <= 0 {
+			return 0, context.DeadlineExceeded
+		}
+	}
+
+	if s.fsm.keyring != nil {
+		var err error
+		msg, err = s.fsm.keyring.encryptMessage(msg)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	s.writeLock.RLock()
+	f := s.raft.Apply(msg, timeout)
+	s.writeLock.RUnlock()
+
 	if f.Error() != nil {
-		return f.Error()
+		if f.Error() == raft.ErrRaftShutdown {
+			return 0, ErrShutdown
+		}
+		return 0, f.Error()
 	}
+	token := ConsistencyToken(f.Index())
 	res := f.Response()
 	if resErr, ok := res.(error); ok {
-		return resErr
+		return token, resErr
 	}
 
-	return nil
+	return token, nil
 }
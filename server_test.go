@@ -0,0 +1,254 @@
+package blehdb
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// testWait bounds how long tests wait for a cluster to settle, such as for an
+// election to finish.
+const testWait = 15 * time.Second
+
+// freeAddr returns a loopback address with a port that is free right now.
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error finding a free port: %v", err)
+	}
+	defer l.Close()
+
+	return l.Addr().String()
+}
+
+// testConfig returns a config with its own storage directory and free ports,
+// which is removed once the test ends.
+func testConfig(t *testing.T) *Config {
+	dir, err := ioutil.TempDir("", "blehdb-server")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	config := DefaultConfig()
+	config.StorageDir = dir
+	config.RaftBind = freeAddr(t)
+	config.RPCBind = freeAddr(t)
+
+	return config
+}
+
+// startServer starts a server that is closed once the test ends.
+func startServer(t *testing.T, config *Config) *Server {
+	s, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("error starting server: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+// testServer starts a server on a fresh config, adjusted by fn if given.
+func testServer(t *testing.T, fn func(*Config)) *Server {
+	config := testConfig(t)
+	if fn != nil {
+		fn(config)
+	}
+
+	return startServer(t, config)
+}
+
+// waitFor polls cond until it holds, failing the test after testWait.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(testWait)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// waitForLeader waits until one of servers is leader and returns it.
+func waitForLeader(t *testing.T, servers ...*Server) *Server {
+	var leader *Server
+	waitFor(t, "a leader", func() bool {
+		for _, s := range servers {
+			if s.raft.State() == raft.Leader {
+				leader = s
+				return true
+			}
+		}
+		return false
+	})
+
+	return leader
+}
+
+// testCluster starts a cluster of n servers, adjusted by fn if given, and
+// waits until every member knows the leader. The first server bootstraps the
+// cluster and the rest join it.
+func testCluster(t *testing.T, n int, fn func(*Config)) []*Server {
+	servers := []*Server{testServer(t, func(c *Config) {
+		c.Bootstrap = true
+		if fn != nil {
+			fn(c)
+		}
+	})}
+	waitForLeader(t, servers[0])
+
+	for i := 1; i < n; i++ {
+		servers = append(servers, testServer(t, func(c *Config) {
+			c.RetryJoin = []string{servers[0].config.RPCAdvertise}
+			if fn != nil {
+				fn(c)
+			}
+		}))
+	}
+
+	waitForMembers(t, servers...)
+
+	return servers
+}
+
+// waitForMembers waits until every one of servers is a peer with a
+// registered RPC address and knows the leader.
+func waitForMembers(t *testing.T, servers ...*Server) {
+	waitFor(t, "members to join", func() bool {
+		for _, s := range servers {
+			if _, ok := s.leaderRPCAddr(); !ok {
+				return false
+			}
+
+			for _, other := range servers {
+				if _, ok := s.fsm.Member(other.id); !ok {
+					return false
+				}
+			}
+		}
+		return true
+	})
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), testWait)
+	t.Cleanup(cancel)
+
+	return ctx
+}
+
+func lastSnapshotIndex(t *testing.T, s *Server) uint64 {
+	index, err := strconv.ParseUint(s.raft.Stats()["last_snapshot_index"], 10, 64)
+	if err != nil {
+		t.Fatalf("error reading snapshot index: %v", err)
+	}
+
+	return index
+}
+
+func TestServerSnapshot(t *testing.T) {
+	s := testServer(t, func(c *Config) { c.Bootstrap = true })
+	waitForLeader(t, s)
+	ctx := testContext(t)
+
+	token, err := s.CreateBucket(ctx, "foo")
+	if err != nil {
+		t.Fatalf("error creating bucket: %v", err)
+	}
+
+	if err := s.Snapshot(); err != nil {
+		t.Fatalf("error taking snapshot: %v", err)
+	}
+
+	if index := lastSnapshotIndex(t, s); index < uint64(token) {
+		t.Errorf("expected a snapshot at or after %d, got: %d", token, index)
+	}
+
+	token, err = s.Set(ctx, "foo", "bar", "baz")
+	if err != nil {
+		t.Fatalf("error setting item: %v", err)
+	}
+
+	var reply string
+	if err := s.callRPC(ctx, s.config.RPCAdvertise, "Management.Snapshot", &SnapshotRequest{}, &reply); err != nil {
+		t.Fatalf("error calling Management.Snapshot: %v", err)
+	}
+
+	if index := lastSnapshotIndex(t, s); index < uint64(token) {
+		t.Errorf("expected the RPC to snapshot at or after %d, got: %d", token, index)
+	}
+
+	s.Close()
+	if err := s.Snapshot(); err != ErrShutdown {
+		t.Errorf("expected ErrShutdown after shutdown, got: %v", err)
+	}
+}
+
+// portsFree reports whether the raft and RPC addresses of config can be bound.
+func portsFree(config *Config) error {
+	for _, addr := range []string{config.RaftBind, config.RPCBind} {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		l.Close()
+	}
+
+	return nil
+}
+
+func TestCloseFreesPorts(t *testing.T) {
+	config := testConfig(t)
+	config.Bootstrap = true
+
+	s := startServer(t, config)
+	waitForLeader(t, s)
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("error closing server: %v", err)
+	}
+
+	if err := portsFree(config); err != nil {
+		t.Errorf("expected Close to free the raft and RPC ports: %v", err)
+	}
+
+	// A server that is shut down without waiting for raft still releases
+	// its ports and stores, so it can be started again.
+	s = startServer(t, config)
+	waitForLeader(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.Shutdown(ctx)
+
+	if err := portsFree(config); err != nil {
+		t.Errorf("expected Shutdown to free the raft and RPC ports: %v", err)
+	}
+}
+
+func TestRetryJoinLateSeed(t *testing.T) {
+	seedConfig := testConfig(t)
+	seedConfig.Bootstrap = true
+
+	// The member is started first and keeps retrying until the seed is up.
+	s := testServer(t, func(c *Config) {
+		c.RetryJoin = []string{seedConfig.RPCBind}
+	})
+
+	time.Sleep(1500 * time.Millisecond)
+	seed := startServer(t, seedConfig)
+
+	waitForMembers(t, seed, s)
+
+	peers, err := seed.servers()
+	if err != nil || !hasServer(peers, s.id) {
+		t.Errorf("expected the member to have joined the seed, got: %v, %v", peers, err)
+	}
+}
@@ -0,0 +1,205 @@
+package blehdb
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/joshkrueger/blehdb/store"
+)
+
+// statusPeerTimeout bounds how long Status waits for each peer to report its
+// progress.
+const statusPeerTimeout = time.Second
+
+// Status describes the local member and its view of the cluster.
+type Status struct {
+	ID       string `json:"id"`
+	Address  string `json:"address"`
+	Role     string `json:"role"`
+	Version  string `json:"version"`
+	Zone     string `json:"zone"`
+	NonVoter bool   `json:"non_voter"`
+
+	Leader   string `json:"leader"`
+	LeaderID string `json:"leader_id"`
+
+	Term              uint64 `json:"term"`
+	LastLogIndex      uint64 `json:"last_log_index"`
+	CommitIndex       uint64 `json:"commit_index"`
+	AppliedIndex      uint64 `json:"applied_index"`
+	LastSnapshotIndex uint64 `json:"last_snapshot_index"`
+
+	Peers []*PeerStatus `json:"peers"`
+	FSM   store.Stats   `json:"fsm"`
+}
+
+// PeerStatus describes another member as seen from the local member.
+type PeerStatus struct {
+	ID         string `json:"id"`
+	Address    string `json:"address"`
+	RPCAddress string `json:"rpc_address"`
+	Zone       string `json:"zone"`
+	NonVoter   bool   `json:"non_voter"`
+
+	// AppliedIndex is the last index the peer has applied, and Lag how far
+	// that trails the local member's last log index.
+	AppliedIndex uint64 `json:"applied_index"`
+	Lag          uint64 `json:"lag"`
+
+	// LastContact is when the peer last heard from the leader.
+	LastContact time.Time `json:"last_contact"`
+
+	// Gossip is "alive", "failed" or "left" as reported by gossip, and
+	// Version is the release the peer gossips. Both are empty without gossip.
+	Gossip  string `json:"gossip,omitempty"`
+	Version string `json:"version,omitempty"`
+
+	// Error is set when the peer could not be reached.
+	Error string `json:"error,omitempty"`
+}
+
+// Status returns the local member's raft state, its view of the cluster and
+// statistics about its FSM. The progress of each peer is fetched over RPC.
+func (s *Server) Status() (*Status, error) {
+	stats := s.raft.Stats()
+
+	status := &Status{
+		ID:           s.id,
+		Address:      s.config.RaftAdvertise,
+		Role:         s.raft.State().String(),
+		Version:      Version,
+		Zone:         s.config.Zone,
+		NonVoter:     s.isNonVoter(),
+		Leader:       s.leaderAddr(),
+		AppliedIndex: s.fsm.AppliedIndex(),
+		FSM:          s.fsm.Store().Stats(),
+	}
+	status.LeaderID = s.leaderID(status.Leader)
+
+	if status.NonVoter {
+		status.Role = "NonVoter"
+	}
+
+	status.Term = parseStat(stats, "term")
+	status.LastLogIndex = parseStat(stats, "last_log_index")
+	status.CommitIndex = parseStat(stats, "commit_index")
+	status.LastSnapshotIndex = parseStat(stats, "last_snapshot_index")
+
+	peers, err := s.peerStatuses(status.LastLogIndex)
+	if err != nil {
+		return nil, err
+	}
+	status.Peers = peers
+
+	return status, nil
+}
+
+func parseStat(stats map[string]string, key string) uint64 {
+	v, _ := strconv.ParseUint(stats[key], 10, 64)
+	return v
+}
+
+// leaderID returns the server ID of the member at the given raft address,
+// looked up in the raft configuration and, failing that, in the registry.
+func (s *Server) leaderID(addr string) string {
+	if addr == "" {
+		return ""
+	}
+
+	if servers, err := s.servers(); err == nil {
+		if srv, ok := serverByAddr(servers, addr); ok {
+			return string(srv.ID)
+		}
+	}
+
+	if m, ok := s.fsm.MemberByAddr(addr); ok {
+		return m.ID
+	}
+
+	return ""
+}
+
+// peerStatuses collects the progress of every other raft peer, voters and
+// non-voters alike, in parallel.
+func (s *Server) peerStatuses(lastIndex uint64) ([]*PeerStatus, error) {
+	servers, err := s.servers()
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[string]*PeerStatus)
+	for _, srv := range servers {
+		byID[string(srv.ID)] = &PeerStatus{
+			ID:       string(srv.ID),
+			Address:  string(srv.Address),
+			NonVoter: srv.Suffrage != raft.Voter,
+		}
+	}
+
+	for _, m := range s.fsm.Members() {
+		// Skip stale registry entries for members that have left raft.
+		if p, ok := byID[m.ID]; ok {
+			p.RPCAddress = m.RPCAddr
+			p.Zone = m.Zone
+		}
+	}
+	delete(byID, s.id)
+
+	if s.gossip != nil {
+		for _, p := range byID {
+			if m, ok := s.gossip.member(p.ID); ok {
+				switch {
+				case m.Alive:
+					p.Gossip = "alive"
+				case m.Left:
+					p.Gossip = "left"
+				default:
+					p.Gossip = "failed"
+				}
+				p.Version = m.Meta.Version
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	var result []*PeerStatus
+	for _, p := range byID {
+		result = append(result, p)
+
+		if p.RPCAddress == "" {
+			p.Error = "RPC address unknown"
+			continue
+		}
+
+		wg.Add(1)
+		go func(p *PeerStatus) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), statusPeerTimeout)
+			defer cancel()
+
+			progress, err := s.progress(ctx, p.RPCAddress)
+			if err != nil {
+				p.Error = err.Error()
+				return
+			}
+
+			p.AppliedIndex = progress.AppliedIndex
+			p.LastContact = progress.LastContact
+			if lastIndex > progress.AppliedIndex {
+				p.Lag = lastIndex - progress.AppliedIndex
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Address < result[j].Address
+	})
+
+	return result, nil
+}
@@ -0,0 +1,91 @@
+package blehdb
+
+import (
+	"testing"
+)
+
+// checkPeerLag checks that a peer's lag is measured against the last log index
+// of the status it was reported in.
+func checkPeerLag(t *testing.T, status *Status, p *PeerStatus) {
+	var lag uint64
+	if status.LastLogIndex > p.AppliedIndex {
+		lag = status.LastLogIndex - p.AppliedIndex
+	}
+
+	if p.Lag != lag {
+		t.Errorf("expected %s to lag %s by %d, got: %d", p.ID, status.ID, lag, p.Lag)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	servers := testCluster(t, 2, nil)
+	leader, follower := servers[0], servers[1]
+	ctx := testContext(t)
+
+	if _, err := leader.CreateBucket(ctx, "foo"); err != nil {
+		t.Fatalf("error creating bucket: %v", err)
+	}
+	token, err := leader.Set(ctx, "foo", "bar", "baz")
+	if err != nil {
+		t.Fatalf("error setting item: %v", err)
+	}
+
+	if err := follower.waitForToken(ctx, token); err != nil {
+		t.Fatalf("error waiting for the follower to apply %d: %v", token, err)
+	}
+
+	status, err := leader.Status()
+	if err != nil {
+		t.Fatalf("error fetching leader status: %v", err)
+	}
+
+	if status.ID != leader.id || status.Address != leader.config.RaftAdvertise || status.Role != "Leader" {
+		t.Errorf("unexpected leader identity: %+v", status)
+	}
+	if status.Leader != leader.config.RaftAdvertise || status.LeaderID != leader.id {
+		t.Errorf("expected the leader to report itself, got: %s (%s)", status.LeaderID, status.Leader)
+	}
+	if status.Term == 0 || status.CommitIndex < uint64(token) || status.AppliedIndex < uint64(token) || status.LastLogIndex < status.CommitIndex {
+		t.Errorf("unexpected leader indexes for a write at %d: %+v", token, status)
+	}
+	if status.FSM.Buckets != 1 || status.FSM.Items != 1 {
+		t.Errorf("expected 1 bucket and 1 item in the FSM stats, got: %+v", status.FSM)
+	}
+
+	if len(status.Peers) != 1 {
+		t.Fatalf("expected the leader to report 1 peer, got: %+v", status.Peers)
+	}
+	p := status.Peers[0]
+	if p.ID != follower.id || p.Address != follower.config.RaftAdvertise || p.RPCAddress != follower.config.RPCAdvertise || p.NonVoter {
+		t.Errorf("unexpected follower as seen from the leader: %+v", p)
+	}
+	if p.Error != "" || p.AppliedIndex < uint64(token) || p.LastContact.IsZero() {
+		t.Errorf("expected the follower's progress, got: %+v", p)
+	}
+	checkPeerLag(t, status, p)
+
+	// A follower reports the same leader and term, and fetches the leader's
+	// progress.
+	var reply Status
+	if err := leader.callRPC(ctx, follower.config.RPCAdvertise, "Management.Status", &StatusRequest{}, &reply); err != nil {
+		t.Fatalf("error calling Management.Status: %v", err)
+	}
+
+	if reply.ID != follower.id || reply.Role != "Follower" {
+		t.Errorf("unexpected follower identity: %+v", reply)
+	}
+	if reply.Leader != leader.config.RaftAdvertise || reply.LeaderID != leader.id || reply.Term != status.Term {
+		t.Errorf("expected the follower to follow %s in term %d, got: %s (%s) in term %d", leader.id, status.Term, reply.LeaderID, reply.Leader, reply.Term)
+	}
+	if reply.CommitIndex < uint64(token) || reply.AppliedIndex < uint64(token) {
+		t.Errorf("unexpected follower indexes for a write at %d: %+v", token, reply)
+	}
+
+	if len(reply.Peers) != 1 || reply.Peers[0].ID != leader.id {
+		t.Fatalf("expected the follower to report the leader, got: %+v", reply.Peers)
+	}
+	if reply.Peers[0].Error != "" || reply.Peers[0].AppliedIndex < uint64(token) {
+		t.Errorf("expected the leader's progress, got: %+v", reply.Peers[0])
+	}
+	checkPeerLag(t, &reply, reply.Peers[0])
+}
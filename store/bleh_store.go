@@ -54,6 +54,29 @@ func (b *BlehStore) ListBuckets() []string {
 	return keys
 }
 
+// Stats summarizes the contents of a store.
+type Stats struct {
+	Buckets int `json:"buckets"`
+	Items   int `json:"items"`
+}
+
+func (b *BlehStore) Stats() Stats {
+	b.bucketLock.RLock()
+	defer b.bucketLock.RUnlock()
+
+	stats := Stats{
+		Buckets: len(b.Buckets),
+	}
+
+	for _, bb := range b.Buckets {
+		bb.itemLock.RLock()
+		stats.Items += len(bb.Items)
+		bb.itemLock.RUnlock()
+	}
+
+	return stats
+}
+
 func (b *BlehStore) BucketExists(name string) bool {
 	b.bucketLock.RLock()
 	defer b.bucketLock.RUnlock()
@@ -108,6 +131,26 @@ func (b *BlehStore) GetItem(bucket, key string) (string, error) {
 	return bb.Get(key)
 }
 
+// Items returns a copy of every item in the bucket, so that callers can work
+// through them without holding the store's locks.
+func (b *BlehStore) Items(bucket string) (map[string]string, error) {
+	b.bucketLock.RLock()
+	defer b.bucketLock.RUnlock()
+
+	bb, ok := b.Buckets[bucket]
+	if !ok {
+		return nil, fmt.Errorf("bucket '%s' does not exist", bucket)
+	}
+
+	items := make(map[string]string)
+	err := bb.ForEach(func(key, value string) error {
+		items[key] = value
+		return nil
+	})
+
+	return items, err
+}
+
 func newBucket() *bucket {
 	return &bucket{
 		Items: make(map[string]*item),
@@ -149,6 +192,19 @@ func (b *bucket) Get(key string) (string, error) {
 	return i.Value, nil
 }
 
+func (b *bucket) ForEach(fn func(key, value string) error) error {
+	b.itemLock.RLock()
+	defer b.itemLock.RUnlock()
+
+	for k, i := range b.Items {
+		if err := fn(k, i.Value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (b *bucket) Delete(key string) error {
 	b.itemLock.Lock()
 	defer b.itemLock.Unlock()
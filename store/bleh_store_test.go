@@ -147,6 +147,51 @@ func TestItem(t *testing.T) {
 	}
 }
 
+func TestItems(t *testing.T) {
+	s := New()
+	s.CreateBucket("foo")
+	s.SetItem("foo", "bar", "baz")
+
+	items, err := s.Items("foo")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if len(items) != 1 || items["bar"] != "baz" {
+		t.Errorf("unexpected items: %v", items)
+	}
+
+	// The copy must not change with the store.
+	s.SetItem("foo", "bar", "qux")
+	if items["bar"] != "baz" {
+		t.Errorf("expected a copy of the items, got: %v", items)
+	}
+
+	s.CreateBucket("empty")
+	items, err = s.Items("empty")
+	if err != nil || len(items) != 0 {
+		t.Errorf("expected no items, got: %v, %v", items, err)
+	}
+
+	if _, err := s.Items("dne"); err == nil {
+		t.Error("Items on non-existent bucket should return an error")
+	}
+}
+
+func TestStats(t *testing.T) {
+	s := New()
+	s.CreateBucket("foo")
+	s.CreateBucket("bar")
+	s.SetItem("foo", "bar", "baz")
+	s.SetItem("foo", "foo", "bar")
+	s.SetItem("bar", "foo", "bar")
+
+	stats := s.Stats()
+	if stats.Buckets != 2 || stats.Items != 3 {
+		t.Errorf("expected 2 buckets and 3 items, got: %+v", stats)
+	}
+}
+
 func TestBackup(t *testing.T) {
 	s := New()
 	s.CreateBucket("foo")
@@ -0,0 +1,181 @@
+package blehdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// transferPollInterval is how often a leadership transfer checks on the
+// target's progress.
+const transferPollInterval = 50 * time.Millisecond
+
+// ErrNoTransferTarget is returned when a leadership transfer has no other
+// voting member to hand leadership to.
+var ErrNoTransferTarget = errors.New("no other voting member to transfer leadership to")
+
+// progress fetches a member's replication progress over RPC.
+func (s *Server) progress(ctx context.Context, rpcAddr string) (*ProgressResponse, error) {
+	var resp ProgressResponse
+	if err := s.callRPC(ctx, rpcAddr, "Management.Progress", &ProgressRequest{}, &resp); err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+// localProgress describes the local member's replication progress.
+func (s *Server) localProgress() *ProgressResponse {
+	return &ProgressResponse{
+		ID:           s.id,
+		Address:      s.config.RaftAdvertise,
+		Leader:       s.leaderAddr(),
+		AppliedIndex: s.fsm.AppliedIndex(),
+		LastContact:  s.lastContact(),
+	}
+}
+
+// otherVoters returns the registry entries of every other voting member, keyed
+// by server ID.
+func (s *Server) otherVoters() (map[string]*member, error) {
+	servers, err := s.servers()
+	if err != nil {
+		return nil, err
+	}
+
+	voters := make(map[string]*member)
+	for _, srv := range servers {
+		id := string(srv.ID)
+		if id == s.id || srv.Suffrage != raft.Voter {
+			continue
+		}
+		if m, ok := s.fsm.Member(id); ok && !m.NonVoter {
+			voters[id] = m
+		}
+	}
+
+	return voters, nil
+}
+
+// bestTransferTarget picks the voting member that has applied the most of
+// the log.
+func (s *Server) bestTransferTarget(ctx context.Context) (string, error) {
+	voters, err := s.otherVoters()
+	if err != nil {
+		return "", err
+	}
+
+	var best string
+	var bestIndex uint64
+	for id, m := range voters {
+		p, err := s.progress(ctx, m.RPCAddr)
+		if err != nil {
+			s.logger.Printf("error fetching progress of %s: %v", id, err)
+			continue
+		}
+
+		if best == "" || p.AppliedIndex > bestIndex {
+			best, bestIndex = id, p.AppliedIndex
+		}
+	}
+
+	if best == "" {
+		return "", ErrNoTransferTarget
+	}
+
+	return best, nil
+}
+
+// TransferLeadership hands leadership to the member with the server ID target,
+// or to the most caught up voting member if target is empty. It can be called
+// on any member; followers forward the request to the leader. The target
+// catches up with the log while writes continue; writes are then paused on
+// the leader while raft hands leadership over, which raft gives up on after
+// an election timeout. The former leader stays a voting follower.
+func (s *Server) TransferLeadership(ctx context.Context, target string) error {
+	return s.retryLeader(ctx, func() error {
+		if s.raft.State() != raft.Leader {
+			var reply string
+			return s.forwardToLeader(ctx, "Management.TransferLeadership", &TransferLeadershipRequest{Target: target}, &reply)
+		}
+
+		return s.transferLeadership(ctx, target)
+	})
+}
+
+// transferLeadership hands leadership from the local leader to target, or to
+// the most caught up voting member if target is empty, and waits until the
+// local member has learned of the new leader.
+func (s *Server) transferLeadership(ctx context.Context, target string) error {
+	var err error
+	if target == "" {
+		target, err = s.bestTransferTarget(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	voters, err := s.otherVoters()
+	if err != nil {
+		return err
+	}
+
+	m, ok := voters[target]
+	if !ok {
+		return fmt.Errorf("'%s' is not a voting member", target)
+	}
+
+	s.logger.Printf("Transferring leadership to %s", target)
+
+	// Let the target catch up while writes continue, so that raft has little
+	// left to send it once writes are paused.
+	if err := s.waitForProgress(ctx, m.RPCAddr, s.fsm.AppliedIndex()); err != nil {
+		return err
+	}
+
+	s.writeLock.Lock()
+	err = s.raft.LeadershipTransferToServer(raft.ServerID(target), raft.ServerAddress(m.RaftAddr)).Error()
+	s.writeLock.Unlock()
+	if err != nil {
+		return fmt.Errorf("transferring leadership: %v", err)
+	}
+
+	// Raft may elect another member if the target fails to win in time.
+	var leader string
+	for leader == "" || leader == s.config.RaftAdvertise {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for a new leader: %v", ctx.Err())
+		case <-time.After(transferPollInterval):
+		}
+
+		leader = string(s.raft.Leader())
+	}
+
+	if leader != m.RaftAddr {
+		return fmt.Errorf("leadership moved to %s instead of %s", leader, target)
+	}
+
+	s.logger.Printf("Leadership transferred to %s", target)
+
+	return nil
+}
+
+// waitForProgress polls the member at targetRPC until it has applied index.
+func (s *Server) waitForProgress(ctx context.Context, targetRPC string, index uint64) error {
+	for {
+		p, err := s.progress(ctx, targetRPC)
+		if err == nil && p.AppliedIndex >= index {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for target to catch up: %v", ctx.Err())
+		case <-time.After(transferPollInterval):
+		}
+	}
+}
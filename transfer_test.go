@@ -0,0 +1,53 @@
+package blehdb
+
+import (
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestTransferLeadership(t *testing.T) {
+	servers := testCluster(t, 3, nil)
+	leader, target := servers[0], servers[2]
+	ctx := testContext(t)
+
+	if _, err := leader.CreateBucket(ctx, "foo"); err != nil {
+		t.Fatalf("error creating bucket: %v", err)
+	}
+
+	if err := leader.TransferLeadership(ctx, target.id); err != nil {
+		t.Fatalf("error transferring leadership: %v", err)
+	}
+
+	if target.raft.State() != raft.Leader {
+		t.Fatalf("expected %s to be leader, got: %v", target.id, target.raft.State())
+	}
+
+	// The former leader keeps its vote, so the cluster never shrinks.
+	if voters, nonVoters := voterCount(t, target); voters != 3 || nonVoters != 0 {
+		t.Errorf("expected every member to keep its vote, got: %d voters, %d non-voters", voters, nonVoters)
+	}
+
+	if _, err := leader.Set(ctx, "foo", "bar", "baz"); err != nil {
+		t.Errorf("error writing after the transfer: %v", err)
+	}
+
+	// Called on a follower, the request is forwarded and the best target is
+	// chosen.
+	if err := leader.TransferLeadership(ctx, ""); err != nil {
+		t.Fatalf("error transferring leadership again: %v", err)
+	}
+
+	if target.raft.State() == raft.Leader {
+		t.Errorf("expected %s to have handed leadership over", target.id)
+	}
+}
+
+func TestTransferLeadershipNoTarget(t *testing.T) {
+	s := testServer(t, func(c *Config) { c.Bootstrap = true })
+	waitForLeader(t, s)
+
+	if err := s.TransferLeadership(testContext(t), ""); err != ErrNoTransferTarget {
+		t.Errorf("expected ErrNoTransferTarget, got: %v", err)
+	}
+}
@@ -0,0 +1,5 @@
+package blehdb
+
+// Version is the BlehDB release. It is exchanged with other members over
+// gossip and reported by Status.
+const Version = "0.1.0"